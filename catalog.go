@@ -0,0 +1,135 @@
+package nodb
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Catalog is one database for database/sql: its own tables & functions.
+// Safe for concurrent use.
+type Catalog struct {
+	mu     sync.RWMutex
+	tables Obj
+}
+
+var (
+	catalogsMu sync.Mutex
+	catalogs   = map[string]*Catalog{} // by lowercased name
+	_          = NewCatalog("cache")
+)
+
+// NewCatalog makes an empty catalog that sql.Open("nodb", name) connects to.
+// It replaces any catalog of that name for connections opened later.
+func NewCatalog(name string) *Catalog {
+	c := &Catalog{tables: make(Obj)}
+	catalogsMu.Lock()
+	catalogs[strings.ToLower(name)] = c
+	catalogsMu.Unlock()
+	return c
+}
+
+func findCatalog(name string) (*Catalog, bool) {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	c, ok := catalogs[strings.ToLower(name)]
+	return c, ok
+}
+
+// NewConnector serves a copy of obj's tables & functions, for sql.OpenDB.
+// Its catalog has no name, so nothing else can reach it.
+func NewConnector(obj Obj) driver.Connector {
+	c := &Catalog{tables: make(Obj, len(obj))}
+	for k, v := range obj {
+		c.tables[k] = v
+	}
+	return c.Connector()
+}
+
+// Add a table ([]struct) or function to the catalog.
+// Add a *[]struct or *[]*struct to allow INSERT, UPDATE and DELETE on it.
+// Replacing a table doesn't disturb queries already running on the old one.
+func (c *Catalog) Add(key string, item interface{}) {
+	c.mu.Lock()
+	c.tables[key] = item
+	c.mu.Unlock()
+}
+
+// Delete a user-added item from the catalog
+func (c *Catalog) Delete(key string) {
+	c.mu.Lock()
+	delete(c.tables, key)
+	c.mu.Unlock()
+}
+
+// Connector for sql.OpenDB(c.Connector())
+func (c *Catalog) Connector() driver.Connector {
+	return connector{c}
+}
+
+// snapshot copies the catalog for one query, so the query keeps these
+// table versions while later Add or Exec calls swap in others.
+func (c *Catalog) snapshot() Obj {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return readable(c.tables)
+}
+
+// writable is a table added as *[]row, which Exec can change. A Table is
+// read as it is, even if it is a pointer to a slice.
+func writable(v interface{}) (reflect.Value, bool) {
+	if _, ok := v.(Table); ok {
+		return reflect.Value{}, false
+	}
+	vo := reflect.ValueOf(v)
+	return vo, vo.Kind() == reflect.Ptr && vo.Elem().Kind() == reflect.Slice
+}
+
+// readable copies tables, reading those added as *[]struct now
+func readable(tables Obj) Obj {
+	obj := make(Obj, len(tables))
+	for k, v := range tables {
+		if vo, ok := writable(v); ok {
+			v = vo.Elem().Interface()
+		}
+		obj[k] = v
+	}
+	return obj
+}
+
+type connector struct {
+	catalog *Catalog
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return Conn{
+		Context: ctx,
+		Cancel:  cancel,
+		catalog: c.catalog,
+		sess:    &session{},
+	}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return NoDBDriver{}
+}
+
+// Add a table ([]struct) or function to the "cache" catalog.
+// Add a *[]struct or *[]*struct to allow INSERT, UPDATE and DELETE on it.
+func Add(key string, item interface{}) {
+	cacheCatalog().Add(key, item)
+}
+
+// Delete a user-added item from the "cache" catalog
+func Delete(key string) {
+	cacheCatalog().Delete(key)
+}
+
+// cacheCatalog is the catalog named "cache" now, as NewCatalog may replace it
+func cacheCatalog() *Catalog {
+	c, _ := findCatalog("cache")
+	return c
+}
@@ -1,6 +1,8 @@
 package nodb
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"strconv"
 
@@ -20,10 +22,24 @@ import (
 // Use it to name tables & custom functions
 type Obj map[string]interface{}
 
+// ErrManyRows is Do's error when a single-row result gets more than one.
+// Getting none is sql.ErrNoRows.
+var ErrManyRows = sel.ErrManyRows
+
 // Do an SQL 'query' against 'src' entries and (copy) results into 'result'
 // See doc.go for more details. src points to tables ([]AnyStruct) and functions
+// result may point to a slice, to a map keyed by the first column, or to a
+// single struct, map[string]interface{} or scalar such as an int for
+// SELECT COUNT(*). A chan result gets rows as they are made, then is closed.
 func Do(query string, result interface{}, src Obj) error {
 	fmt.Println(query)
+	if q, ok := splitExplain(query); ok {
+		tree, err := parseSelect(q)
+		if err != nil {
+			return err
+		}
+		return sel.DoExplain(tree, result, base.Obj(src))
+	}
 	tree, err := sqlparser.Parse(query)
 	if err != nil {
 		return err
@@ -50,6 +66,20 @@ func Filter(query string, result interface{}, input interface{}) error {
 		result, Obj{"t0": input})
 }
 
+// Sorted marks a table ([]struct or chan struct) as already in order,
+// for example Sorted(orders, "custID", "when DESC"). Joins on its first
+// field can then merge in one pass rather than caching or hashing a side.
+// Rows out of the declared order make the query fail.
+func Sorted(table interface{}, by ...string) interface{} {
+	return base.SortedTable{Table: table, By: by}
+}
+
+// Columns declares the columns of a []map[string]interface{} table, which
+// are otherwise found by reading every row. Rows lacking one read NULL.
+func Columns(rows []map[string]interface{}, columns ...string) interface{} {
+	return base.MapTable{Table: rows, Columns: columns}
+}
+
 func EnableLogging() {
 	base.Debug = fmt.Println
 }
@@ -93,3 +123,70 @@ func Inline(result interface{}, inlineQuery ...interface{}) error {
 	}
 	return Do(strings.Join(str, ""), result, obj)
 }
+
+// DoArgs is Do with ? and :name placeholders filled from args.
+// Args fill ?s in order. Pass sql.Named("name", v) for :name.
+func DoArgs(query string, result interface{}, src Obj, args ...interface{}) error {
+	return Do(query, result, bindArgs(src, namedArgs(args)))
+}
+
+// namedArgs numbers args from 1, unwrapping sql.Named ones
+func namedArgs(args []interface{}) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+		if n, ok := a.(sql.NamedArg); ok {
+			named[i].Name, named[i].Value = n.Name, n.Value
+		}
+	}
+	return named
+}
+
+// bindArgs copies src adding args under their placeholder names: ":v1" for
+// the first ?, ":name" for :name.
+func bindArgs(src Obj, args []driver.NamedValue) Obj {
+	if len(args) == 0 {
+		return src
+	}
+	obj := make(Obj, len(src)+len(args))
+	for k, v := range src {
+		obj[k] = v
+	}
+	for _, a := range args {
+		if a.Name != "" {
+			obj[":"+a.Name] = a.Value
+		} else {
+			obj[":v"+strconv.Itoa(a.Ordinal)] = a.Value
+		}
+	}
+	return obj
+}
+
+// bindNames lists the distinct placeholders in a parsed statement
+func bindNames(node interface{}) map[string]bool {
+	names := map[string]bool{}
+	valArg := reflect.TypeOf(sqlparser.ValArg(nil))
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if !v.IsNil() {
+				walk(v.Elem())
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				walk(v.Field(i))
+			}
+		case reflect.Slice:
+			if v.Type() == valArg {
+				names[string(v.Bytes())] = true
+			} else if v.Type().Elem().Kind() != reflect.Uint8 {
+				for i := 0; i < v.Len(); i++ {
+					walk(v.Index(i))
+				}
+			}
+		}
+	}
+	walk(reflect.ValueOf(node))
+	return names
+}
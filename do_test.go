@@ -1,10 +1,23 @@
 package nodb
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/sel"
+	"github.com/xwb1989/sqlparser"
 )
 
 type Foo struct {
@@ -186,6 +199,42 @@ func Test_GroupBy4(t *testing.T) {
 	})
 }
 
+func Test_Case(t *testing.T) {
+	Convey("simple CASE in SELECT", t, func() {
+		results := []Foo{}
+		err := Do("SELECT a, CASE a WHEN 1 THEN 'one' WHEN 2 THEN 'two' ELSE 'many' END AS b FROM src WHERE a < 4",
+			&results, Obj{"src": srcG})
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []Foo{{1, "one"}, {2, "two"}, {3, "many"}})
+	})
+	Convey("searched CASE in WHERE", t, func() {
+		results := []Foo{}
+		err := Do("SELECT * FROM src WHERE CASE WHEN a > 3 THEN b ELSE 'x' END = 'hello'", &results, Obj{"src": srcG})
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []Foo{{5, "hello"}})
+	})
+	Convey("CASE inside an aggregate", t, func() {
+		results := []Foo{}
+		err := Do("SELECT SUM(CASE WHEN b = 'hello' THEN a ELSE 0 END) AS a FROM src", &results, Obj{"src": srcG})
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []Foo{{9, ""}})
+	})
+	Convey("CASE in GROUP BY", t, func() {
+		results := []Foo{}
+		err := Do("SELECT SUM(A) AS A, CASE WHEN a > 2 THEN 'big' ELSE 'small' END AS b FROM src "+
+			"GROUP BY CASE WHEN a > 2 THEN 'big' ELSE 'small' END ORDER BY A", &results, Obj{"src": srcG})
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []Foo{{3, "small"}, {12, "big"}})
+	})
+	Convey("CASE in ORDER BY, NULL without ELSE", t, func() {
+		results := []Foo{}
+		err := Do("SELECT a, CASE b WHEN 'world' THEN b END AS b FROM src ORDER BY CASE b WHEN 'world' THEN 0 ELSE 1 END, a",
+			&results, Obj{"src": srcG})
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []Foo{{2, "world"}, {4, "world"}, {1, ""}, {3, ""}, {5, ""}})
+	})
+}
+
 type rs struct {
 	Ct  int
 	Max float64
@@ -250,6 +299,201 @@ func Test_join(t *testing.T) {
 		Do("SELECT * from tmp ORDER BY a", &result, Obj{"tmp": tmp})
 		So(result, ShouldResemble, []Foo{{1, ""}, {2, ""}, {2, ""}, {3, ""}, {3, ""}, {4, ""}})
 	})
+	Convey("other set operations are an error", t, func() {
+		// the parser knows only UNION, so make the others by hand
+		tree, err := sqlparser.Parse("SELECT a FROM first UNION SELECT a FROM second")
+		So(err, ShouldBeNil)
+		tree.(*sqlparser.Union).Type = sqlparser.AST_EXCEPT
+		result := []Foo{}
+		err = sel.Do(tree.(sqlparser.SelectStatement), &result, base.Obj{"first": left, "second": right})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "Simple Union only")
+	})
+}
+
+func Test_hashJoin(t *testing.T) {
+	Convey("extra ON condition", t, func() {
+		result := []Foo{}
+		So(Do("SELECT a, second.b AS b FROM first JOIN second ON second.A=first.A AND second.b != 'X'",
+			&result,
+			Obj{"first": left, "second": right}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{3, "Y"}})
+	})
+	Convey("left with extra ON condition", t, func() {
+		result := []Foo{}
+		So(Do("SELECT a, second.b AS b FROM first LEFT JOIN second ON first.A=second.A AND second.b != 'X'",
+			&result,
+			Obj{"first": left, "second": right}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}, {2, ""}, {3, "Y"}})
+	})
+	Convey("duplicate keys", t, func() {
+		result := []Foo{}
+		So(Do("SELECT first.a AS a, second.b AS b FROM first JOIN second ON first.b=second.b",
+			&result,
+			Obj{"first": srcG, "second": []Foo{{0, "world"}, {0, "world"}}}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{2, "world"}, {2, "world"}, {4, "world"}, {4, "world"}})
+	})
+	Convey("infinite keys", t, func() {
+		type pt struct {
+			X float64
+			B string
+		}
+		type res struct {
+			X    float64
+			L, R string
+		}
+		inf := math.Inf(1)
+		result := []res{}
+		So(Do("SELECT l.x AS x, l.b AS l, r.b AS r FROM l JOIN r ON l.x = r.x",
+			&result,
+			Obj{"l": []pt{{inf, "a"}, {1, "b"}, {math.Inf(-1), "c"}}, "r": []pt{{1, "y"}, {inf, "z"}}}), ShouldBeNil)
+		So(result, ShouldResemble, []res{{inf, "a", "z"}, {1, "b", "y"}})
+	})
+}
+
+func Test_whereBeforeJoin(t *testing.T) {
+	Convey("per-table WHERE parts", t, func() {
+		result := []Foo{}
+		So(Do("SELECT first.a AS a, second.b AS b FROM first JOIN second ON first.A=second.A "+
+			"WHERE second.b != 'X' AND first.a > 1 AND (first.b = 'C' OR second.b = 'Z')",
+			&result,
+			Obj{"first": left, "second": right}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{3, "Y"}})
+	})
+}
+
+func Test_Null(t *testing.T) {
+	leftJoin := "SELECT first.a AS a, second.b AS b FROM first LEFT JOIN second ON first.A=second.A "
+	obj := Obj{"first": left, "second": right}
+	Convey("IS NULL on the NULL side of a LEFT JOIN", t, func() {
+		result := []Foo{}
+		So(Do(leftJoin+"WHERE second.b IS NULL", &result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}})
+	})
+	Convey("IS NOT NULL", t, func() {
+		result := []Foo{}
+		So(Do(leftJoin+"WHERE second.b IS NOT NULL", &result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{2, "X"}, {3, "Y"}})
+	})
+	Convey("comparisons with NULL are unknown, not true", t, func() {
+		result := []Foo{}
+		So(Do(leftJoin+"WHERE second.b = 'X' OR NOT second.b = 'X'", &result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{2, "X"}, {3, "Y"}})
+	})
+	Convey("unknown OR true, unknown AND false", t, func() {
+		result := []Foo{}
+		So(Do(leftJoin+"WHERE (second.b LIKE 'X%' OR first.a = 1) AND NOT (second.b = 'Y' AND first.a = 3)",
+			&result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}, {2, "X"}})
+	})
+	Convey("NOT IN a list holding NULL", t, func() {
+		result := []Foo{}
+		So(Do("SELECT * FROM first WHERE a NOT IN (2, NULL)", &result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{})
+	})
+	Convey("ORDER BY puts NULL first", t, func() {
+		result := []Foo{}
+		So(Do(leftJoin+"ORDER BY b", &result, obj), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}, {2, "X"}, {3, "Y"}})
+	})
+}
+
+func Test_mergeJoin(t *testing.T) {
+	Convey("sorted channels", t, func() {
+		result := []Foo{}
+		first := make(chan Foo, 3)
+		second := make(chan Foo, 4)
+		for _, f := range left {
+			first <- f
+		}
+		for _, f := range []Foo{{2, "X"}, {3, "Y"}, {3, "W"}, {4, "Z"}} {
+			second <- f
+		}
+		close(first)
+		close(second)
+		So(Do("SELECT first.a AS a, second.b AS b FROM first LEFT JOIN second ON first.A=second.A",
+			&result,
+			Obj{"first": Sorted(first, "A"), "second": Sorted(second, "a")}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}, {2, "X"}, {3, "Y"}, {3, "W"}})
+	})
+	Convey("descending", t, func() {
+		result := []Foo{}
+		So(Do("SELECT first.a AS a, second.b AS b FROM first JOIN second ON first.A=second.A",
+			&result,
+			Obj{"first": Sorted([]Foo{{3, "C"}, {2, "B"}, {1, "A"}}, "A DESC"),
+				"second": Sorted([]Foo{{4, "Z"}, {3, "Y"}, {2, "X"}}, "A desc")}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{3, "Y"}, {2, "X"}})
+	})
+	Convey("not really sorted", t, func() {
+		result := []Foo{}
+		err := Do("SELECT first.a AS a FROM first JOIN second ON first.A=second.A",
+			&result,
+			Obj{"first": Sorted(left, "A"), "second": Sorted([]Foo{{3, "Y"}, {2, "X"}}, "A")})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("keys of different kinds just don't match", t, func() {
+		result := []Foo{}
+		So(Do("SELECT first.a AS a FROM first JOIN second ON first.B=second.A",
+			&result,
+			Obj{"first": Sorted([]Foo{{1, "1"}, {2, "2"}}, "B"), "second": Sorted(left, "A")}), ShouldBeNil)
+		So(result, ShouldBeEmpty)
+	})
+	Convey("a channel table is read out when the left side ends first", t, func() {
+		second := make(chan Foo)
+		sent := make(chan bool)
+		go func() {
+			for i := 1; i <= 100; i++ {
+				second <- Foo{i, ""}
+			}
+			close(second)
+			close(sent)
+		}()
+		result := []Foo{}
+		So(Do("SELECT first.a AS a FROM first JOIN second ON first.A=second.A",
+			&result,
+			Obj{"first": Sorted([]Foo{{1, ""}, {2, ""}}, "A"), "second": Sorted(second, "A")}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, ""}, {2, ""}})
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			So("sender still blocked", ShouldBeEmpty)
+		}
+	})
+}
+
+func Test_explain(t *testing.T) {
+	Convey("plan", t, func() {
+		p, err := Explain("SELECT first.a AS a, second.b AS b FROM first LEFT JOIN second ON first.A=second.A "+
+			"WHERE first.a > 1 AND second.b != 'X' GROUP BY second.b ORDER BY a LIMIT 2",
+			Obj{"first": left, "second": right})
+		So(err, ShouldBeNil)
+		So(len(p.Tables), ShouldEqual, 2)
+		So(p.Tables[0].Name, ShouldEqual, "first")
+		So(p.Tables[0].Strategy, ShouldEqual, "scan")
+		So(p.Tables[0].Filter, ShouldEqual, "first.a > 1")
+		So(p.Tables[0].UsedFields, ShouldResemble, []string{"A"})
+		So(p.Tables[1].Join, ShouldEqual, "left join")
+		So(p.Tables[1].Strategy, ShouldEqual, "hash")
+		So(p.Tables[1].On, ShouldEqual, "first.a = second.a")
+		So(p.Tables[1].UsedFields, ShouldResemble, []string{"A", "B"})
+		So(p.Where, ShouldEqual, "second.b != 'X'")
+		So(p.GroupBy, ShouldEqual, "second.b")
+		So(p.OrderBy, ShouldEqual, "a asc")
+		So(p.Distinct, ShouldBeFalse)
+		So(p.Limit, ShouldEqual, "2")
+	})
+	Convey("EXPLAIN statement", t, func() {
+		type step struct{ Step, Table, Detail string }
+		result := []step{}
+		So(Do("EXPLAIN SELECT DISTINCT first.a AS a FROM first JOIN second ON first.A=second.A",
+			&result,
+			Obj{"first": Sorted(left, "A"), "second": Sorted(right, "A")}), ShouldBeNil)
+		So(result, ShouldResemble, []step{
+			{"scan", "first", "fields A"},
+			{"join (merge)", "second", "on first.a = second.a; fields A"},
+			{"distinct", "", ""},
+		})
+	})
 }
 
 func Test_Bools1(t *testing.T) {
@@ -392,6 +636,121 @@ type custResultType []struct {
 	MonthlyTotal float64
 }
 
+func Test_Exists(t *testing.T) {
+	customers := []CustomerEntry{
+		{1, "Bob", "b@ob.com", "m"},
+		{2, "Best", "b@est.com", "f"},
+		{3, "Nope", "n@ope.com", "m"}}
+	orders := []OrderEntry{{50, 1, time.Now()}, {30, 2, time.Now()}, {25, 2, time.Now()}}
+	type name struct{ Name string }
+	Convey("correlated EXISTS", t, func() {
+		result := []name{}
+		So(Do("SELECT name FROM cust c WHERE EXISTS (SELECT * FROM o WHERE o.custID = c.id)",
+			&result, Obj{"cust": customers, "o": orders}), ShouldBeNil)
+		So(result, ShouldResemble, []name{{"Bob"}, {"Best"}})
+	})
+	Convey("NOT EXISTS reads a channel table only once", t, func() {
+		ch := make(chan OrderEntry, len(orders))
+		for _, o := range orders {
+			ch <- o
+		}
+		close(ch)
+		result := []name{}
+		So(Do("SELECT name FROM cust c WHERE NOT EXISTS (SELECT 1 FROM o WHERE c.id = o.custID AND o.total > 20)",
+			&result, Obj{"cust": customers, "o": ch}), ShouldBeNil)
+		So(result, ShouldResemble, []name{{"Nope"}})
+	})
+	Convey("correlated beyond equalities", t, func() {
+		result := []name{}
+		So(Do("SELECT name FROM cust c WHERE EXISTS (SELECT * FROM o WHERE o.custID = c.id AND o.total > c.id * 20)",
+			&result, Obj{"cust": customers, "o": orders}), ShouldBeNil)
+		So(result, ShouldResemble, []name{{"Bob"}})
+	})
+	Convey("correlated without equalities reads a channel table for every row", t, func() {
+		ch := make(chan OrderEntry, len(orders))
+		for _, o := range orders {
+			ch <- o
+		}
+		close(ch)
+		result := []name{}
+		So(Do("SELECT name FROM cust c WHERE EXISTS (SELECT * FROM o WHERE o.total > c.id * 20)",
+			&result, Obj{"cust": customers, "o": Sorted(ch, "total DESC")}), ShouldBeNil)
+		So(result, ShouldResemble, []name{{"Bob"}, {"Best"}})
+	})
+	Convey("a channel table read by the query and its subquery", t, func() {
+		ch := make(chan OrderEntry, len(orders))
+		for _, o := range orders {
+			ch <- o
+		}
+		close(ch)
+		type total struct{ Total float64 }
+		result := []total{}
+		So(Do("SELECT total FROM o WHERE EXISTS (SELECT * FROM o AS o2 WHERE o2.total > o.total)",
+			&result, Obj{"o": ch}), ShouldBeNil)
+		So(result, ShouldResemble, []total{{30}, {25}})
+	})
+	Convey("uncorrelated EXISTS", t, func() {
+		result := []name{}
+		So(Do("SELECT name FROM cust WHERE EXISTS (SELECT * FROM o WHERE total > 1000)",
+			&result, Obj{"cust": customers, "o": orders}), ShouldBeNil)
+		So(result, ShouldResemble, []name{})
+	})
+	Convey("correlated IN", t, func() {
+		result := []Foo{}
+		So(Do("SELECT * FROM src s WHERE a IN (SELECT a + 2 FROM src WHERE b = s.b)",
+			&result, Obj{"src": srcG}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{3, "hello"}, {4, "world"}, {5, "hello"}})
+	})
+}
+
+func Test_ScalarSubquery(t *testing.T) {
+	Convey("in SELECT", t, func() {
+		result := []Foo{}
+		So(Do("SELECT (SELECT MAX(a) FROM src) AS a, b FROM src WHERE a = 2", &result, Obj{"src": srcG}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{5, "world"}})
+	})
+	Convey("in a comparison", t, func() {
+		result := []Foo{}
+		So(Do("SELECT * FROM src WHERE a > (SELECT AVG(a) FROM src)", &result, Obj{"src": srcG}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{4, "world"}, {5, "hello"}})
+	})
+	Convey("correlated", t, func() {
+		result := []Foo{}
+		So(Do("SELECT a, b FROM src s WHERE a = (SELECT MIN(a) FROM src WHERE b = s.b)", &result, Obj{"src": srcG}),
+			ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{1, "hello"}, {2, "world"}})
+	})
+	Convey("more than one row", t, func() {
+		result := []Foo{}
+		err := Do("SELECT * FROM src WHERE a = (SELECT a FROM src)", &result, Obj{"src": srcG})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "more than 1 row")
+	})
+}
+
+func Test_Args(t *testing.T) {
+	Convey("positional", t, func() {
+		result := []Foo{}
+		So(DoArgs("SELECT * FROM src WHERE a > ? AND b = ?", &result, Obj{"src": srcG}, 2, "hello"), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{3, "hello"}, {5, "hello"}})
+	})
+	Convey("named", t, func() {
+		result := []Foo{}
+		So(DoArgs("SELECT * FROM src WHERE a BETWEEN :lo AND :hi OR b = :lo", &result, Obj{"src": srcG},
+			sql.Named("lo", 4), sql.Named("hi", 5)), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{4, "world"}, {5, "hello"}})
+	})
+	Convey("quotes are data", t, func() {
+		result := []Foo{}
+		So(DoArgs("SELECT * FROM src WHERE b = ?", &result, Obj{"src": srcG}, "x' OR 'a'='a"), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{})
+	})
+	Convey("missing", t, func() {
+		result := []Foo{}
+		So(DoArgs("SELECT * FROM src WHERE a = ?", &result, Obj{"src": srcG}), ShouldNotBeNil)
+	})
+}
+
 func Test_Inline(t *testing.T) {
 	Convey("Inline", t, func() {
 		result := []Foo{}
@@ -425,6 +784,27 @@ func Test_Inline(t *testing.T) {
 	})
 }
 
+func Test_Between(t *testing.T) {
+	Convey("numbers", t, func() {
+		result := []Foo{}
+		So(Do("SELECT * FROM src WHERE a BETWEEN 2 AND 4", &result, Obj{"src": srcG}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{2, "world"}, {3, "hello"}, {4, "world"}})
+	})
+	Convey("NOT BETWEEN strings", t, func() {
+		result := []Foo{}
+		So(Do("SELECT * FROM src WHERE b NOT BETWEEN 'a' AND 'i'", &result, Obj{"src": srcG}), ShouldBeNil)
+		So(result, ShouldResemble, []Foo{{2, "world"}, {4, "world"}})
+	})
+	Convey("times", t, func() {
+		day := func(d int) time.Time { return time.Date(2016, 1, d, 0, 0, 0, 0, time.UTC) }
+		orders := []OrderEntry{{1, 1, day(1)}, {2, 1, day(5)}, {3, 1, day(9)}}
+		result := []OrderEntry{}
+		So(Inline(&result, "SELECT * FROM", orders, "AS o WHERE whenCompleted BETWEEN", day(2), "AND", day(9)),
+			ShouldBeNil)
+		So(result, ShouldResemble, orders[1:])
+	})
+}
+
 type CountRes struct {
 	Count int
 }
@@ -444,3 +824,505 @@ func Test_Distinct(t *testing.T) {
 		So(r, ShouldResemble, []CountRes{{1}, {2}, {3}, {4}})
 	})
 }
+
+func Test_Query(t *testing.T) {
+	type Row struct {
+		A int
+		B string
+	}
+	src := Obj{"t": []Foo2{{1, "x"}, {2, "y"}, {3, "z"}}}
+	ctx := context.Background()
+	Convey("Query[T]", t, func() {
+		rows, err := Query[Row](ctx, "SELECT a, b FROM t WHERE a > ?", src, 1)
+		So(err, ShouldBeNil)
+		So(rows, ShouldResemble, []Row{{2, "y"}, {3, "z"}})
+
+		maps, err := Query[map[string]interface{}](ctx, "SELECT b FROM t WHERE a = :a", src, sql.Named("a", 3))
+		So(err, ShouldBeNil)
+		So(maps, ShouldResemble, []map[string]interface{}{{"b": "z"}})
+
+		_, err = Query[[]int](ctx, "SELECT a FROM t", src)
+		So(err, ShouldNotBeNil)
+		_, err = Query[int](ctx, "SELECT a, b FROM t", src)
+		So(err, ShouldNotBeNil)
+		_, err = Query[Row](ctx, "SELECT nope FROM t", src)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("QueryOne[T]", t, func() {
+		r, err := QueryOne[Row](ctx, "SELECT * FROM t ORDER BY a DESC", src)
+		So(err, ShouldBeNil)
+		So(r, ShouldResemble, Row{3, "z"})
+		_, err = QueryOne[Row](ctx, "SELECT * FROM t WHERE a > 5", src)
+		So(err, ShouldEqual, sql.ErrNoRows)
+	})
+	Convey("QuerySeq[T] stops when told", t, func() {
+		seen := 0
+		for r, err := range QuerySeq[Row](ctx, "SELECT * FROM t", src) {
+			So(err, ShouldBeNil)
+			seen += r.A
+			if seen >= 3 {
+				break
+			}
+		}
+		So(seen, ShouldEqual, 3)
+	})
+}
+
+func Test_Each(t *testing.T) {
+	Convey("Each streams from a channel and stops on error", t, func() {
+		ch := make(chan Foo)
+		done := make(chan struct{})
+		defer close(done)
+		go func() { // endless: only streaming can finish
+			defer close(ch)
+			for i := 0; ; i++ {
+				select {
+				case ch <- Foo{i, "x"}:
+				case <-done:
+					return
+				}
+			}
+		}()
+		stop := errors.New("enough")
+		got := []int{}
+		err := Each(context.Background(), "SELECT a FROM ch WHERE a > 1", Obj{"ch": ch}, func(f Foo) error {
+			got = append(got, f.A)
+			if len(got) == 3 {
+				return stop
+			}
+			return nil
+		})
+		So(err, ShouldEqual, stop)
+		So(got, ShouldResemble, []int{2, 3, 4})
+	})
+	Convey("Each reports query errors", t, func() {
+		err := Each(context.Background(), "SELECT nope FROM t", Obj{"t": []Foo{{1, ""}}}, func(Foo) error { return nil })
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_Prepare(t *testing.T) {
+	Convey("Prepare checks once & runs on fresh data", t, func() {
+		p, err := Prepare("SELECT a, b FROM t WHERE a > ? ORDER BY a", Obj{"t": []Foo{}})
+		So(err, ShouldBeNil)
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res := []Foo{}
+				errs[i] = p.Do(&res, Obj{"t": []Foo{{i, "x"}, {i + 1, "y"}}}, i)
+				if errs[i] == nil && !reflect.DeepEqual(res, []Foo{{i + 1, "y"}}) {
+					errs[i] = fmt.Errorf("run %d got %v", i, res)
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			So(err, ShouldBeNil)
+		}
+
+		rows, err := QueryPrepared[Foo](context.Background(), p, Obj{"t": []Foo{{1, "a"}, {5, "b"}}}, 2)
+		So(err, ShouldBeNil)
+		So(rows, ShouldResemble, []Foo{{5, "b"}})
+
+		So(p.Do(&[]Foo{}, Obj{"t": []Foo{}}), ShouldNotBeNil) // arg missing
+	})
+	Convey("a Prepared RIGHT JOIN runs concurrently without changing", t, func() {
+		p, err := Prepare("SELECT l.a AS a, r.b AS b FROM l RIGHT JOIN r ON l.a = r.a", nil)
+		So(err, ShouldBeNil)
+		src := Obj{"l": []Foo{{1, "x"}}, "r": []Foo{{1, "one"}, {2, "two"}}}
+		var wg sync.WaitGroup
+		results := make([][]Foo, 8)
+		errs := make([]error, len(results))
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = []Foo{}
+				errs[i] = p.Do(&results[i], src)
+			}(i)
+		}
+		wg.Wait()
+		for i, res := range results {
+			So(errs[i], ShouldBeNil)
+			So(res, ShouldResemble, []Foo{{1, "one"}, {0, "two"}})
+		}
+	})
+	Convey("each run binds its own tables, args & functions, in subqueries too", t, func() {
+		p, err := Prepare(`SELECT o.a AS a, tag(o.b) AS b FROM o
+			WHERE o.a >= ? AND EXISTS (SELECT i.a FROM i WHERE i.a = o.a AND i.b <> o.b)`,
+			Obj{"o": []Foo{}, "i": []Foo{}, "tag": func(s string) string { return s }})
+		So(err, ShouldBeNil)
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res := []Foo{}
+				errs[i] = p.Do(&res, Obj{
+					"o":   []Foo{{i - 1, "w"}, {i, "x"}, {i + 1, "y"}},
+					"i":   []Foo{{i, "x"}, {i + 1, "z"}},
+					"tag": func(s string) string { return s + strconv.Itoa(i) },
+				}, i)
+				if want := []Foo{{i + 1, "y" + strconv.Itoa(i)}}; errs[i] == nil && !reflect.DeepEqual(res, want) {
+					errs[i] = fmt.Errorf("run %d got %v", i, res)
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			So(err, ShouldBeNil)
+		}
+	})
+	Convey("a run on tables laid out otherwise is refused", t, func() {
+		p, err := Prepare("SELECT a FROM t", Obj{"t": []Foo{}})
+		So(err, ShouldBeNil)
+		So(p.Do(&[]Foo{}, Obj{"t": []*Foo{{1, "a"}}}), ShouldNotBeNil) // rows may be nil
+		So(p.Do(&[]Foo{}, Obj{"t": []struct{ A int }{{1}}}), ShouldNotBeNil)
+		err = p.Do(&[]Foo{}, Obj{"t": []struct {
+			A string
+			B string
+		}{{"1", "a"}}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "not laid out as")
+		res := []Foo{}
+		So(p.Do(&res, Obj{"t": []Foo{{1, "a"}}}), ShouldBeNil)
+		So(res, ShouldResemble, []Foo{{1, ""}})
+
+		p, err = Prepare("SELECT a FROM t", nil) // the first run's tables build it
+		So(err, ShouldBeNil)
+		So(p.Do(&res, Obj{"t": []struct{ A int }{{2}}}), ShouldBeNil)
+		So(p.Do(&res, Obj{"t": []Foo{{1, "a"}}}), ShouldNotBeNil)
+	})
+	Convey("Prepare rejects what can't run", t, func() {
+		_, err := Prepare("SELECT nope FROM t", Obj{"t": []Foo{}})
+		So(err, ShouldNotBeNil)
+		_, err = Prepare("DELETE FROM t", nil)
+		So(err, ShouldNotBeNil)
+		_, err = Prepare("SELECT nope FROM t", nil) // nothing to check against
+		So(err, ShouldBeNil)
+	})
+}
+
+func Test_SingleRow(t *testing.T) {
+	src := Obj{"t": []Foo{{1, "x"}, {2, "y"}, {3, "z"}}}
+	Convey("one struct", t, func() {
+		var f Foo
+		So(Do("SELECT * FROM t WHERE a = 2", &f, src), ShouldBeNil)
+		So(f, ShouldResemble, Foo{2, "y"})
+		So(Do("SELECT * FROM t WHERE a > 5", &f, src), ShouldEqual, sql.ErrNoRows)
+		So(Do("SELECT * FROM t", &f, src), ShouldEqual, ErrManyRows)
+	})
+	Convey("scalars", t, func() {
+		var n int
+		So(Do("SELECT COUNT(*) FROM t", &n, src), ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		var avg float64
+		So(Do("SELECT AVG(a) FROM t", &avg, src), ShouldBeNil)
+		So(avg, ShouldEqual, 2)
+		var s string
+		So(Do("SELECT b FROM t WHERE a = 3", &s, src), ShouldBeNil)
+		So(s, ShouldEqual, "z")
+		So(Do("SELECT a, b FROM t WHERE a = 3", &s, src), ShouldNotBeNil)
+		So(Do("SELECT b FROM t WHERE a = 3", &n, src), ShouldNotBeNil)
+	})
+	Convey("a slice of scalars", t, func() {
+		names := []string{}
+		So(Do("SELECT b FROM t ORDER BY a DESC", &names, src), ShouldBeNil)
+		So(names, ShouldResemble, []string{"z", "y", "x"})
+	})
+	Convey("QueryOne of a scalar", t, func() {
+		max, err := QueryOne[int](context.Background(), "SELECT MAX(a) FROM t", src)
+		So(err, ShouldBeNil)
+		So(max, ShouldEqual, 3)
+	})
+}
+
+func Test_MapAndChanResults(t *testing.T) {
+	src := Obj{"t": []Foo{{1, "x"}, {2, "y"}, {3, "z"}}}
+	Convey("a slice of maps", t, func() {
+		res := []map[string]any{}
+		So(Do("SELECT a, b AS name FROM t WHERE a < 3", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []map[string]any{{"a": 1, "name": "x"}, {"a": 2, "name": "y"}})
+	})
+	Convey("a map keyed by the first column", t, func() {
+		byA := map[int]Foo{}
+		So(Do("SELECT a, b FROM t", &byA, src), ShouldBeNil)
+		So(byA, ShouldResemble, map[int]Foo{1: {1, "x"}, 2: {2, "y"}, 3: {3, "z"}})
+
+		var names map[string]int
+		So(Do("SELECT b, a * 10 FROM t", &names, src), ShouldBeNil)
+		So(names, ShouldResemble, map[string]int{"x": 10, "y": 20, "z": 30})
+
+		dup := map[string]int{}
+		So(Do("SELECT 'k', a FROM t", &dup, src), ShouldNotBeNil)
+	})
+	Convey("a channel", t, func() {
+		ch := make(chan Foo)
+		errCh := make(chan error, 1)
+		go func() { errCh <- Do("SELECT * FROM t ORDER BY a DESC", ch, src) }()
+		got := []Foo{}
+		for f := range ch {
+			got = append(got, f)
+		}
+		So(<-errCh, ShouldBeNil)
+		So(got, ShouldResemble, []Foo{{3, "z"}, {2, "y"}, {1, "x"}})
+
+		So(Do("SELECT * FROM t", (<-chan Foo)(make(chan Foo)), src), ShouldNotBeNil)
+	})
+}
+
+func Test_Tags(t *testing.T) {
+	type Customer struct {
+		CustomerID int    `nodb:"customer_id"`
+		FullName   string `db:"full_name"`
+		Both       string `nodb:"shown" db:"ignored"`
+		Secret     string `nodb:"-"`
+	}
+	type Out struct {
+		ID   int    `db:"customer_id"`
+		Name string `nodb:"full_name,omitempty"`
+		Skip string `nodb:"-"`
+	}
+	custs := []Customer{{1, "Ann", "a", "pw1"}, {2, "Bob", "b", "pw2"}}
+	src := Obj{"c": custs}
+	Convey("tags name the columns of tables & results", t, func() {
+		res := []Out{}
+		So(Do("SELECT customer_id, full_name FROM c WHERE customer_id > 1", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{2, "Bob", ""}})
+
+		all := []map[string]interface{}{}
+		So(Do("SELECT * FROM c WHERE shown = 'a'", &all, src), ShouldBeNil)
+		So(all, ShouldResemble, []map[string]interface{}{{"customer_id": 1, "full_name": "Ann", "shown": "a"}})
+
+		So(Do("SELECT full_name AS skip FROM c", &res, src), ShouldBeNil)
+		So(res[len(res)-1].Skip, ShouldEqual, "")
+	})
+	Convey("Go names and hidden fields are not columns", t, func() {
+		res := []Out{}
+		So(Do("SELECT customerid FROM c", &res, src), ShouldNotBeNil)
+		So(Do("SELECT secret FROM c", &res, src), ShouldNotBeNil)
+		So(Do("SELECT ignored FROM c", &res, src), ShouldNotBeNil)
+	})
+	Convey("FROM subqueries keep SQL column names", t, func() {
+		res := []Out{}
+		So(Do("SELECT full_name FROM (SELECT full_name FROM c WHERE customer_id = 2) AS s", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{0, "Bob", ""}})
+	})
+}
+
+func Test_NestedFields(t *testing.T) {
+	type Address struct {
+		City string
+		Zip  *int
+	}
+	type Audit struct {
+		Created int
+	}
+	type Person struct {
+		Name string
+	}
+	type Order struct {
+		Audit   // promoted: created
+		ID      int
+		Address Address
+		Manager *Person
+	}
+	zip := 12345
+	orders := []Order{
+		{Audit{3}, 1, Address{"Oslo", &zip}, &Person{"Ann"}},
+		{Audit{1}, 2, Address{"Rome", nil}, nil},
+		{Audit{2}, 3, Address{"Oslo", nil}, &Person{"Bob"}},
+	}
+	type Out struct {
+		ID      int
+		City    string
+		Zip     *int
+		Name    string
+		Created int
+		N       int
+	}
+	src := Obj{"o": orders, "cities": []struct{ Name, Country string }{{"Oslo", "NO"}, {"Rome", "IT"}}}
+	Convey("dotted paths in SELECT, WHERE & ORDER BY", t, func() {
+		res := []Out{}
+		So(Do("SELECT id, address.city, address.zip, manager.name FROM o WHERE address.city = 'Oslo' ORDER BY manager.name DESC", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{ID: 3, City: "Oslo", Name: "Bob"}, {ID: 1, City: "Oslo", Zip: &zip, Name: "Ann"}})
+	})
+	Convey("nil pointers are NULL", t, func() {
+		res := []Out{}
+		So(Do("SELECT id FROM o WHERE manager.name IS NULL", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{ID: 2}})
+		res = []Out{}
+		So(Do("SELECT id FROM o WHERE address.zip IS NOT NULL", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{ID: 1}})
+	})
+	Convey("promoted fields, qualified paths, JOIN ON & GROUP BY", t, func() {
+		res := []Out{}
+		So(Do("SELECT id, created FROM o WHERE o.created > 1 ORDER BY created", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{ID: 3, Created: 2}, {ID: 1, Created: 3}})
+
+		res = []Out{}
+		So(Do("SELECT cities.country AS name, COUNT(*) AS n FROM o JOIN cities ON o.`address.city` = cities.name GROUP BY address.city ORDER BY n", &res, src), ShouldBeNil)
+		So(res, ShouldResemble, []Out{{Name: "IT", N: 1}, {Name: "NO", N: 2}})
+	})
+	Convey("nil struct pointers are NULL too", t, func() {
+		type Job struct {
+			ID      int
+			Done    *time.Time
+			Manager *Person
+		}
+		now := time.Now()
+		jobs := Obj{"j": []Job{{1, &now, &Person{"Ann"}}, {2, nil, nil}}}
+		ids := []int{}
+		So(Do("SELECT id FROM j WHERE done IS NULL", &ids, jobs), ShouldBeNil)
+		So(ids, ShouldResemble, []int{2})
+		ids = []int{}
+		So(Do("SELECT id FROM j WHERE manager IS NULL", &ids, jobs), ShouldBeNil)
+		So(ids, ShouldResemble, []int{2})
+		ids = []int{}
+		So(Do("SELECT id FROM j WHERE manager IS NOT NULL AND done IS NOT NULL", &ids, jobs), ShouldBeNil)
+		So(ids, ShouldResemble, []int{1})
+	})
+	Convey("unknown paths fail", t, func() {
+		res := []Out{}
+		So(Do("SELECT address.street FROM o", &res, src), ShouldNotBeNil)
+		So(Do("SELECT id.x FROM o", &res, src), ShouldNotBeNil)
+	})
+}
+
+func Test_MoreTableKinds(t *testing.T) {
+	type Entity struct {
+		ID   int
+		Name string
+	}
+	type Other struct{ ID int }
+	Convey("[]*T and chan *T", t, func() {
+		ents := []*Entity{{1, "a"}, nil, {3, "c"}}
+		res := []map[string]interface{}{}
+		So(Do("SELECT id, name FROM e WHERE id IS NOT NULL ORDER BY id DESC", &res, Obj{"e": ents}), ShouldBeNil)
+		So(res, ShouldResemble, []map[string]interface{}{{"id": 3, "name": "c"}, {"id": 1, "name": "a"}})
+
+		ch := make(chan *Entity, 2)
+		ch <- &Entity{5, "e"}
+		ch <- &Entity{6, "f"}
+		close(ch)
+		names := []string{}
+		So(Do("SELECT name FROM ch WHERE id > 5", &names, Obj{"ch": ch}), ShouldBeNil)
+		So(names, ShouldResemble, []string{"f"})
+	})
+	Convey("[]map[string]any, found or declared", t, func() {
+		rows := []map[string]any{{"id": 1, "name": "a"}, {"id": 2, "extra": true}}
+		res := []map[string]interface{}{}
+		So(Do("SELECT * FROM m", &res, Obj{"m": rows}), ShouldBeNil)
+		So(res, ShouldResemble, []map[string]interface{}{
+			{"extra": nil, "id": 1, "name": "a"},
+			{"extra": true, "id": 2, "name": nil}})
+
+		ids := []int{}
+		So(Do("SELECT id FROM m WHERE name IS NULL", &ids, Obj{"m": Columns(rows, "id", "name")}), ShouldBeNil)
+		So(ids, ShouldResemble, []int{2})
+		So(Do("SELECT extra FROM m", &ids, Obj{"m": Columns(rows, "id", "name")}), ShouldNotBeNil)
+	})
+	Convey("slices of interfaces holding one struct type", t, func() {
+		objs := []interface{}{Entity{1, "a"}, &Entity{2, "b"}}
+		ids := []int{}
+		So(Do("SELECT id FROM o", &ids, Obj{"o": objs}), ShouldBeNil)
+		So(ids, ShouldResemble, []int{1, 2})
+
+		So(Do("SELECT id FROM o", &ids, Obj{"o": []interface{}{Entity{1, "a"}, Other{2}}}), ShouldNotBeNil)
+		So(Do("SELECT id FROM o", &ids, Obj{"o": []int{1}}), ShouldNotBeNil)
+	})
+}
+
+// ring is a Table kept in a fixed buffer, oldest row first
+type ring struct {
+	buf   []Foo
+	start int
+	fail   error // Next's error after the first row, if set
+	opens  int
+	closes atomic.Int32
+}
+
+func (r *ring) Columns() []Column {
+	return []Column{{Name: "a", Type: reflect.TypeOf(0)}, {Name: "b", Type: reflect.TypeOf("")}}
+}
+
+func (r *ring) Open() (Cursor, error) {
+	r.opens++
+	return &ringCursor{r: r}, nil
+}
+
+type ringCursor struct {
+	r *ring
+	n int
+}
+
+func (c *ringCursor) Next(dest []interface{}) error {
+	if c.n > 0 && c.r.fail != nil {
+		return c.r.fail
+	}
+	if c.n == len(c.r.buf) {
+		return io.EOF
+	}
+	f := c.r.buf[(c.r.start+c.n)%len(c.r.buf)]
+	dest[0], dest[1] = f.A, f.B
+	c.n++
+	return nil
+}
+
+func (c *ringCursor) Close() error {
+	c.r.closes.Add(1)
+	return nil
+}
+
+func Test_Table(t *testing.T) {
+	r := &ring{buf: []Foo{{3, "c"}, {1, "a"}, {2, "b"}}, start: 1}
+	Convey("a Table in Obj is read in place", t, func() {
+		res := []Foo{}
+		So(Do("SELECT * FROM r WHERE a > 1", &res, Obj{"r": r}), ShouldBeNil)
+		So(res, ShouldResemble, []Foo{{2, "b"}, {3, "c"}})
+	})
+	Convey("as the inner side of a join it is read more than once", t, func() {
+		r.opens = 0
+		res := []Foo{}
+		So(Do("SELECT l.a AS a, r.b AS b FROM l JOIN r ON l.a < r.a ORDER BY a, b", &res,
+			Obj{"r": r, "l": []Foo{{1, ""}, {2, ""}}}), ShouldBeNil)
+		So(res, ShouldResemble, []Foo{{1, "b"}, {1, "c"}, {2, "c"}})
+		So(r.opens, ShouldBeGreaterThan, 0)
+	})
+	Convey("cursor errors stop the query", t, func() {
+		bad := &ring{buf: r.buf, fail: errors.New("disk on fire")}
+		res := []Foo{}
+		err := Do("SELECT * FROM r", &res, Obj{"r": bad})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "disk on fire")
+	})
+	Convey("every cursor is closed, however the query stops", t, func() {
+		// closing happens as the reading goroutine exits, so wait for it
+		allClosed := func(r *ring) bool {
+			for i := 0; i < 100 && int(r.closes.Load()) < r.opens; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return int(r.closes.Load()) == r.opens
+		}
+		big := &ring{buf: make([]Foo, 100)}
+		res := []Foo{}
+		So(Do("SELECT * FROM r LIMIT 1", &res, Obj{"r": big}), ShouldBeNil)
+		So(res, ShouldHaveLength, 1)
+		So(allClosed(big), ShouldBeTrue)
+
+		big = &ring{buf: make([]Foo, 100)}
+		for _, err := range QuerySeq[Foo](context.Background(), "SELECT * FROM r", Obj{"r": big}) {
+			So(err, ShouldBeNil)
+			break
+		}
+		So(allClosed(big), ShouldBeTrue)
+
+		bad := &ring{buf: r.buf, fail: errors.New("disk on fire")}
+		So(Do("SELECT * FROM r", &res, Obj{"r": bad}), ShouldNotBeNil)
+		So(allClosed(bad), ShouldBeTrue)
+	})
+}
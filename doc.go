@@ -11,12 +11,18 @@ JS has Filter, Map, Sort, and Reduce, but GoLang has more:
 
 With this library,
 - any struct is a table definition (its public members)
-- any slice of a struct is a table itself
+- any slice of a struct is a table itself, as are slices of pointers to
+  structs, of interfaces holding one struct type, and of map[string]interface{}
+- anything implementing Table (Columns & Open) is a table read in place
 - Joins, arbitrary functions, rich WHERE filters and aggregations are possible.
 
 The result is a slice of any struct, and it's appended-to in a best-effort way
 based on name (either the columns or the result of an AS statement).
 
+A field's column name is its `nodb:"name"` tag, else its `db:"name"` tag (as
+sqlx uses), else its Go name. This holds for tables and result structs alike.
+Tag a field `nodb:"-"` to hide it.
+
 Capitalization is freeform, but recommended to be SQL-style (keywords capitalized, vars not).
 Example:
 
@@ -35,7 +41,9 @@ Example:
   })
   //result ==  [ {0.6 WOOL} {0.8 WOOL} {0.2 BAA} ]
 
-Note: If inputA or inputB had pointer members the pointer only would be copied.
+Fields of nested structs read as address.city (or t.`address.city`), and
+fields of embedded structs as their own. Pointers are followed; a nil one is
+NULL. Pointers to structs are copied as pointers when selected whole.
 If inputA or inputB contained structs with private members (time.Time) non-pointer copies will error.
 
 An error state does not guarantee an empty result slice.
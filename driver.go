@@ -6,43 +6,47 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/kr/pretty"
 	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/dml"
 	"github.com/snadrus/nodb/internal/sel"
 	"github.com/xwb1989/sqlparser"
 )
 
 type NoDBDriver struct{}
 
+// Open connects to the catalog named s. "cache" is the one Add fills.
 func (n NoDBDriver) Open(s string) (driver.Conn, error) {
-	if strings.ToLower(s) != "cache" {
-		return nil, errors.New("Unsupported")
+	c, err := n.OpenConnector(s)
+	if err != nil {
+		return nil, err
 	}
+	return c.Connect(context.Background())
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	return Conn{
-		Context: ctx,
-		Cancel:  cancel,
-	}, nil
+// OpenConnector finds the catalog named s once, for sql.OpenDB
+func (n NoDBDriver) OpenConnector(s string) (driver.Connector, error) {
+	c, ok := findCatalog(s)
+	if !ok {
+		return nil, fmt.Errorf("No catalog named %s", s)
+	}
+	return c.Connector(), nil
 }
 
 type Conn struct {
 	context.Context
-	Cancel context.CancelFunc
+	Cancel  context.CancelFunc
+	catalog *Catalog
+	sess    *session
 }
 
 func (c Conn) Begin() (driver.Tx, error) {
-	return Tx{}, nil
+	return c.BeginTx(context.Background(), driver.TxOptions{})
 }
 
-type Tx struct{}
-
-func (t Tx) Commit() error   { return nil }
-func (t Tx) Rollback() error { return nil }
-
 func (c Conn) Close() error {
+	c.sess.tx = nil
 	c.Cancel()
 	return nil
 }
@@ -52,13 +56,17 @@ func (c Conn) Prepare(s string) (driver.Stmt, error) {
 		Context: ctx,
 		Cancel:  cancel,
 		S:       s,
+		catalog: c.catalog,
+		sess:    c.sess,
 	}, nil
 }
 
 type Stmt struct {
 	context.Context
-	Cancel context.CancelFunc
-	S      string
+	Cancel  context.CancelFunc
+	S       string
+	catalog *Catalog
+	sess    *session
 }
 
 func (s Stmt) Close() error {
@@ -66,17 +74,102 @@ func (s Stmt) Close() error {
 	return nil
 }
 
+// NumInput counts distinct placeholders: each ? and each :name
 func (s Stmt) NumInput() int {
-	return -1 // Default for We Don't Know
+	q, _ := splitExplain(s.S)
+	tree, err := sqlparser.Parse(q)
+	if err != nil {
+		return -1 // Query will tell
+	}
+	return len(bindNames(tree))
 }
 
+// Exec runs INSERT, UPDATE or DELETE on tables added as *[]struct or *[]*struct
 func (s Stmt) Exec(args []driver.Value) (driver.Result, error) {
-	return nil, errors.New("Exec not supported for Read-only system")
+	return s.exec(s.Context, namedValues(args))
+}
+
+// ExecContext is Exec with ? and :name args. Cancelling ctx undoes it.
+func (s Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.exec(ctx, args)
+}
+
+func (s Stmt) exec(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	tree, err := sqlparser.Parse(s.S)
+	if err != nil {
+		return nil, err
+	}
+	base.Debug(pretty.Sprint(tree))
+
+	if _, ok := tree.(sqlparser.SelectStatement); ok {
+		return nil, errors.New("Exec cannot SELECT, use Query")
+	}
+	if err := checkArgs(tree, args); err != nil {
+		return nil, err
+	}
+	n, err := s.write(tree, args, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+// write changes the open transaction's copies, else the catalog's tables
+func (s Stmt) write(tree sqlparser.Statement, args []driver.NamedValue, ctx context.Context) (int64, error) {
+	if tx := s.sess.tx; tx != nil {
+		if tx.readOnly {
+			return 0, errors.New("Cannot change tables in a read-only transaction")
+		}
+		return dml.Do(tree, base.Obj(bindArgs(tx.tables, args)), ctx)
+	}
+	s.catalog.mu.Lock() // one writer at a time, and no snapshots mid-write
+	defer s.catalog.mu.Unlock()
+	return dml.Do(tree, base.Obj(bindArgs(s.catalog.tables, args)), ctx)
+}
+
+// snapshot is what a query reads: the open transaction's view, else the catalog's
+func (s Stmt) snapshot() Obj {
+	if tx := s.sess.tx; tx != nil {
+		return readable(tx.tables)
+	}
+	return s.catalog.snapshot()
 }
 
 func (s Stmt) Query(args []driver.Value) (driver.Rows, error) {
-	if len(args) != 0 {
-		return nil, errors.New("Cannot take prepared statements yet, TODO")
+	return s.query(s.Context, namedValues(args))
+}
+
+// checkArgs is database/sql's NumInput check, which it skips for Conn's
+// QueryContext & ExecContext
+func checkArgs(tree sqlparser.Statement, args []driver.NamedValue) error {
+	if want := len(bindNames(tree)); want != len(args) {
+		return fmt.Errorf("sql: expected %d arguments, got %d", want, len(args))
+	}
+	return nil
+}
+
+// namedValues numbers positional args from 1
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// QueryContext runs with ? and :name args until ctx or the statement ends.
+func (s Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.query(ctx, args)
+}
+
+func (s Stmt) query(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	obj := base.Obj(bindArgs(s.snapshot(), args))
+	if q, ok := splitExplain(s.S); ok {
+		tree, err := parseSelect(q)
+		if err != nil {
+			return nil, err
+		}
+		return sel.DoAryExplain(tree, obj)
 	}
 	tree, err := sqlparser.Parse(s.S)
 	if err != nil {
@@ -84,29 +177,70 @@ func (s Stmt) Query(args []driver.Value) (driver.Rows, error) {
 	}
 
 	base.Debug(pretty.Sprint(tree))
+	if err := checkArgs(tree, args); err != nil {
+		return nil, err
+	}
 
 	switch tree.(type) {
-	case *sqlparser.Select:
-		return sel.DoAry(tree.(*sqlparser.Select), base.Obj(cache), s.Context)
+	case sqlparser.SelectStatement:
+		ctx, cancel := context.WithCancel(ctx)
+		stop := context.AfterFunc(s.Context, cancel) // Close ends it too
+		return sel.DoAry(tree.(sqlparser.SelectStatement), obj, ctx, func() {
+			stop()
+			cancel()
+		})
 	default:
 		return nil, fmt.Errorf("Query type not supported")
 	}
 }
 
-// TODO add locking
-var cache Obj
+// stmt is a statement living as long as the Conn, for the Conn's own
+// QueryContext and ExecContext. Nothing to Close.
+func (c Conn) stmt(query string) Stmt {
+	return Stmt{
+		Context: c.Context,
+		Cancel:  func() {},
+		S:       query,
+		catalog: c.catalog,
+		sess:    c.sess,
+	}
+}
+
+// PrepareContext is Prepare; the statement outlives ctx.
+func (c Conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Prepare(query)
+}
 
-// Add a table ([]struct) or function to the database
-func Add(key string, item interface{}) {
-	cache[key] = item
+// QueryContext runs query without a separate Prepare. Cancelling ctx stops it.
+func (c Conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.stmt(query).QueryContext(ctx, args)
 }
 
-// Delete a user-added item from the database
-func Delete(key string) {
-	delete(cache, key)
+// ExecContext runs INSERT, UPDATE or DELETE without a separate Prepare
+func (c Conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.stmt(query).ExecContext(ctx, args)
+}
+
+// Ping fails once the Conn is closed
+func (c Conn) Ping(ctx context.Context) error {
+	if c.Context.Err() != nil {
+		return driver.ErrBadConn
+	}
+	return ctx.Err()
+}
+
+// ResetSession readies a pooled Conn for reuse, dropping any transaction left open.
+func (c Conn) ResetSession(ctx context.Context) error {
+	if c.Context.Err() != nil {
+		return driver.ErrBadConn
+	}
+	c.sess.tx = nil
+	return nil
 }
 
 func init() {
-	cache = make(Obj)
 	sql.Register("nodb", &NoDBDriver{})
 }
@@ -1,8 +1,13 @@
 package nodb
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	. "github.com/smartystreets/goconvey/convey"
@@ -45,3 +50,471 @@ func Test_EasiestDB(t *testing.T) {
 
 	})
 }
+
+func Test_ExplainDB(t *testing.T) {
+	Add("src", []Foo2{{1, "hello"}, {2, "world"}})
+	Convey("EXPLAIN through database/sql", t, func() {
+		conn, err := sql.Open("nodb", "cache")
+		So(err, ShouldBeNil)
+		rows, err := conn.Query("EXPLAIN SELECT a FROM src WHERE b = 'hello'")
+		So(err, ShouldBeNil)
+		c, err := rows.Columns()
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, []string{"Step", "Table", "Detail"})
+		var step, table, detail string
+		So(rows.Next(), ShouldBeTrue)
+		So(rows.Scan(&step, &table, &detail), ShouldBeNil)
+		So(step, ShouldEqual, "scan")
+		So(table, ShouldEqual, "src")
+		So(detail, ShouldEqual, "filter b = 'hello'; fields A, B")
+		So(rows.Next(), ShouldBeFalse)
+	})
+}
+
+func Test_ArgsDB(t *testing.T) {
+	Add("src", []Foo2{{1, "hello"}, {2, "world"}})
+	Convey("? args", t, func() {
+		conn := sqlx.MustConnect("nodb", "cache")
+		var results []Foo2
+		So(conn.Select(&results, "SELECT * FROM src WHERE a = ? OR b = ?", 1, "nope"), ShouldBeNil)
+		So(results, ShouldResemble, []Foo2{{1, "hello"}})
+	})
+	Convey("named args", t, func() {
+		conn, err := sql.Open("nodb", "cache")
+		So(err, ShouldBeNil)
+		var b string
+		So(conn.QueryRow("SELECT b FROM src WHERE a = :a", sql.Named("a", 2)).Scan(&b), ShouldBeNil)
+		So(b, ShouldEqual, "world")
+	})
+	Convey("wrong arg count", t, func() {
+		conn, err := sql.Open("nodb", "cache")
+		So(err, ShouldBeNil)
+		_, err = conn.Query("SELECT b FROM src WHERE a = ?")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_ExecDB(t *testing.T) {
+	Convey("INSERT, UPDATE & DELETE", t, func() {
+		tbl := []Foo2{{1, "hello"}, {2, "world"}}
+		Add("tbl", &tbl)
+		conn := sqlx.MustConnect("nodb", "cache")
+
+		res, err := conn.Exec("INSERT INTO tbl (b, a) VALUES ('three', 3), (?, 4)", "four")
+		So(err, ShouldBeNil)
+		n, err := res.RowsAffected()
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(tbl, ShouldResemble, []Foo2{{1, "hello"}, {2, "world"}, {3, "three"}, {4, "four"}})
+
+		res, err = conn.Exec("UPDATE tbl SET b = 'big', a = a * 10 WHERE a > ?", 2)
+		So(err, ShouldBeNil)
+		n, _ = res.RowsAffected()
+		So(n, ShouldEqual, 2)
+
+		res, err = conn.Exec("DELETE FROM tbl WHERE b = 'hello'")
+		So(err, ShouldBeNil)
+		n, _ = res.RowsAffected()
+		So(n, ShouldEqual, 1)
+
+		var results []Foo2
+		So(conn.Select(&results, "SELECT * FROM tbl"), ShouldBeNil)
+		So(results, ShouldResemble, []Foo2{{2, "world"}, {30, "big"}, {40, "big"}})
+
+		res, err = conn.Exec("INSERT INTO tbl SELECT a + 1, b FROM tbl WHERE a = 2")
+		So(err, ShouldBeNil)
+		n, _ = res.RowsAffected()
+		So(n, ShouldEqual, 1)
+
+		_, err = conn.Exec("DELETE FROM tbl")
+		So(err, ShouldBeNil)
+		results = nil
+		So(conn.Select(&results, "SELECT * FROM tbl"), ShouldBeNil)
+		So(results, ShouldBeEmpty)
+	})
+	Convey("Exec errors", t, func() {
+		tbl := []Foo2{{1, "hello"}}
+		Add("tbl", &tbl)
+		Add("src", []Foo2{{1, "hello"}})
+		conn := sqlx.MustConnect("nodb", "cache")
+		_, err := conn.Exec("DELETE FROM src")
+		So(err, ShouldNotBeNil) // not a pointer
+		_, err = conn.Exec("INSERT INTO tbl (a) VALUES (1, 'x')")
+		So(err, ShouldNotBeNil)
+		_, err = conn.Exec("UPDATE tbl SET a = 'text'")
+		So(err, ShouldNotBeNil)
+		So(tbl, ShouldResemble, []Foo2{{1, "hello"}}) // unchanged
+	})
+}
+
+func Test_ConcurrentDB(t *testing.T) {
+	Convey("Add, Exec & Query together", t, func() {
+		tbl := []Foo2{{1, "a"}}
+		Add("conc", &tbl)
+		conn := sqlx.MustConnect("nodb", "cache")
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				Add("other", []Foo2{{i, "x"}})
+				Delete("gone")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				conn.Exec("INSERT INTO conc VALUES (?, 'b')", i)
+			}
+		}()
+		for i := 0; i < 50; i++ {
+			var results []Foo2
+			So(conn.Select(&results, "SELECT * FROM conc"), ShouldBeNil)
+			So(results, ShouldNotBeEmpty)
+		}
+		wg.Wait()
+		var n int
+		So(conn.Get(&n, "SELECT COUNT(*) FROM conc"), ShouldBeNil)
+		So(n, ShouldEqual, 51)
+	})
+}
+
+func Test_CatalogsDB(t *testing.T) {
+	Convey("Catalogs keep their tables apart", t, func() {
+		NewCatalog("tenantA").Add("t", []Foo2{{1, "a"}})
+		NewCatalog("tenantB").Add("t", []Foo2{{2, "b"}})
+		for name, want := range map[string][]Foo2{"tenantA": {{1, "a"}}, "tenantb": {{2, "b"}}} {
+			conn := sqlx.MustConnect("nodb", name)
+			var results []Foo2
+			So(conn.Select(&results, "SELECT * FROM t"), ShouldBeNil)
+			So(results, ShouldResemble, want)
+		}
+		_, err := sqlx.Connect("nodb", "nosuch")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Connector from an Obj", t, func() {
+		tbl := []Foo2{{3, "c"}}
+		conn := sqlx.NewDb(sql.OpenDB(NewConnector(Obj{"t": &tbl})), "nodb")
+		_, err := conn.Exec("UPDATE t SET b = 'C'")
+		So(err, ShouldBeNil)
+		var results []Foo2
+		So(conn.Select(&results, "SELECT * FROM t"), ShouldBeNil)
+		So(results, ShouldResemble, []Foo2{{3, "C"}})
+		So(conn.Select(&results, "SELECT * FROM src"), ShouldNotBeNil) // "cache" only
+	})
+	Convey("Add fills the catalog named cache, even a new one", t, func() {
+		old := cacheCatalog()
+		defer func() {
+			catalogsMu.Lock()
+			catalogs["cache"] = old
+			catalogsMu.Unlock()
+		}()
+		NewCatalog("cache")
+		Add("fresh", []Foo2{{4, "d"}})
+		conn := sqlx.MustConnect("nodb", "cache")
+		var results []Foo2
+		So(conn.Select(&results, "SELECT * FROM fresh"), ShouldBeNil)
+		So(results, ShouldResemble, []Foo2{{4, "d"}})
+	})
+}
+
+func Test_TxDB(t *testing.T) {
+	Convey("Commit & Rollback", t, func() {
+		tbl := []Foo2{{1, "a"}}
+		NewCatalog("txdb").Add("t", &tbl)
+		conn := sqlx.MustConnect("nodb", "txdb")
+		count := func(q sqlx.Queryer) (n int) {
+			So(sqlx.Get(q, &n, "SELECT COUNT(*) FROM t"), ShouldBeNil)
+			return n
+		}
+
+		tx := conn.MustBegin()
+		tx.MustExec("INSERT INTO t VALUES (2, 'b')")
+		So(count(tx), ShouldEqual, 2)   // sees its own writes
+		So(count(conn), ShouldEqual, 1) // others don't, yet
+		So(tx.Rollback(), ShouldBeNil)
+		So(count(conn), ShouldEqual, 1)
+
+		tx = conn.MustBegin()
+		tx.MustExec("INSERT INTO t VALUES (2, 'b')")
+		tx.MustExec("DELETE FROM t WHERE a = 1")
+		So(tx.Commit(), ShouldBeNil)
+		So(tbl, ShouldResemble, []Foo2{{2, "b"}})
+	})
+	Convey("Consistent reads & write conflicts", t, func() {
+		tbl := []Foo2{{1, "a"}}
+		NewCatalog("txdb").Add("t", &tbl)
+		conn := sqlx.MustConnect("nodb", "txdb")
+		tx := conn.MustBegin()
+		conn.MustExec("UPDATE t SET b = 'outside'")
+		var b string
+		So(tx.Get(&b, "SELECT b FROM t"), ShouldBeNil)
+		So(b, ShouldEqual, "a") // still the Begin snapshot
+		tx.MustExec("UPDATE t SET b = 'inside'")
+		So(tx.Commit(), ShouldNotBeNil) // first committer won
+		So(tbl, ShouldResemble, []Foo2{{1, "outside"}})
+
+		tx = conn.MustBegin()
+		tx.MustExec("UPDATE t SET b = 'nothing' WHERE a = 9")
+		conn.MustExec("UPDATE t SET b = 'again'")
+		So(tx.Commit(), ShouldBeNil) // changed nothing, so no conflict
+	})
+	Convey("TxOptions", t, func() {
+		tbl := []Foo2{{1, "a"}}
+		NewCatalog("txdb").Add("t", &tbl)
+		conn := sqlx.MustConnect("nodb", "txdb")
+		tx, err := conn.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+		So(err, ShouldBeNil)
+		_, err = tx.Exec("DELETE FROM t")
+		So(err, ShouldNotBeNil)
+		So(tx.Rollback(), ShouldBeNil)
+
+		tx, err = conn.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+		So(err, ShouldBeNil)
+		So(tx.Commit(), ShouldBeNil)
+		_, err = conn.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_ContextDB(t *testing.T) {
+	Convey("Cancelling stops a long join", t, func() {
+		big := make([]Foo2, 2000)
+		for i := range big {
+			big[i].A = i
+		}
+		Add("big", big)
+		conn := sqlx.MustConnect("nodb", "cache")
+		So(conn.Ping(), ShouldBeNil)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		rows, err := conn.QueryContext(ctx,
+			"SELECT x.a FROM big AS x JOIN big AS y ON x.a < y.a JOIN big AS z ON y.a < z.a WHERE z.a < 0")
+		if err == nil {
+			So(rows.Next(), ShouldBeFalse)
+			So(rows.Err(), ShouldNotBeNil)
+			rows.Close()
+		}
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+	})
+	Convey("Cancelling a GROUP BY", t, func() {
+		conn := sqlx.MustConnect("nodb", "cache")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		var n []int
+		err := conn.SelectContext(ctx, &n, "SELECT COUNT(*) FROM big AS x JOIN big AS y ON x.a < y.a GROUP BY x.b")
+		So(err, ShouldNotBeNil)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+	})
+	Convey("Cancelling a correlated subquery", t, func() {
+		conn := sqlx.MustConnect("nodb", "cache")
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		var n []int
+		err := conn.SelectContext(ctx, &n, `SELECT x.a FROM big AS x WHERE EXISTS
+			(SELECT y.a FROM big AS y JOIN big AS z ON y.a < z.a WHERE y.a = x.a AND z.a < 0)`)
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+	})
+	Convey("Conn-level Exec & Query", t, func() {
+		tbl := []Foo2{{1, "a"}}
+		Add("ctxt", &tbl)
+		db, err := sql.Open("nodb", "cache")
+		So(err, ShouldBeNil)
+		c, err := db.Conn(context.Background())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, err = c.ExecContext(context.Background(), "UPDATE ctxt SET b = ?", "b")
+		So(err, ShouldBeNil)
+		var b string
+		So(c.QueryRowContext(context.Background(), "SELECT b FROM ctxt").Scan(&b), ShouldBeNil)
+		So(b, ShouldEqual, "b")
+		So(c.PingContext(context.Background()), ShouldBeNil)
+	})
+}
+
+type Typed struct {
+	ID    int
+	Name  string
+	Score float64
+	When  time.Time
+	Ptr   *int
+	Any   interface{}
+}
+
+func Test_ColumnTypesDB(t *testing.T) {
+	Add("typed", []Typed{{ID: 1, Name: "a", Any: 5}})
+	Add("src", []Foo2{{1, "hello"}})
+	conn := sqlx.MustConnect("nodb", "cache")
+	colTypes := func(q string) []*sql.ColumnType {
+		rows, err := conn.Query(q)
+		So(err, ShouldBeNil)
+		defer rows.Close()
+		cts, err := rows.ColumnTypes()
+		So(err, ShouldBeNil)
+		return cts
+	}
+	Convey("Fields keep their struct types", t, func() {
+		cts := colTypes("SELECT * FROM typed")
+		So(len(cts), ShouldEqual, 6)
+		want := []interface{}{0, "", 0.0, time.Time{}, (*int)(nil)}
+		names := []string{"INTEGER", "TEXT", "REAL", "TIMESTAMP", ""}
+		for i, w := range want {
+			So(cts[i].ScanType(), ShouldEqual, reflect.TypeOf(w))
+			So(cts[i].DatabaseTypeName(), ShouldEqual, names[i])
+		}
+		So(cts[5].ScanType(), ShouldEqual, reflect.TypeOf((*interface{})(nil)).Elem())
+		nullable, ok := cts[0].Nullable()
+		So(nullable, ShouldBeFalse)
+		So(ok, ShouldBeTrue)
+		nullable, ok = cts[4].Nullable()
+		So(nullable && ok, ShouldBeTrue)
+		_, ok = cts[5].Nullable()
+		So(ok, ShouldBeFalse)
+	})
+	Convey("Expressions", t, func() {
+		cts := colTypes(`SELECT id + 1 AS n, name + '!' AS s, UPPER(name) AS u, id > 0 AS b,
+			CASE WHEN id > 0 THEN 'y' ELSE 'n' END AS c, (SELECT MAX(a) FROM src) AS m, 7 AS k
+			FROM typed`)
+		want := []interface{}{0.0, "", "", true, "", 0.0, 0}
+		for i, w := range want {
+			So(cts[i].ScanType(), ShouldEqual, reflect.TypeOf(w))
+		}
+		nullable, ok := cts[5].Nullable()
+		So(nullable && ok, ShouldBeTrue) // no rows gives NULL
+	})
+	Convey("Aggregates & LEFT JOIN", t, func() {
+		cts := colTypes("SELECT COUNT(*) AS ct, SUM(id) AS total FROM typed")
+		So(cts[0].ScanType(), ShouldEqual, reflect.TypeOf(0))
+		So(cts[1].ScanType(), ShouldEqual, reflect.TypeOf(0.0))
+		cts = colTypes("SELECT typed.id, src.b FROM typed LEFT JOIN src ON src.a = typed.id")
+		nullable, _ := cts[0].Nullable()
+		So(nullable, ShouldBeFalse)
+		nullable, ok := cts[1].Nullable()
+		So(nullable && ok, ShouldBeTrue)
+		So(cts[1].ScanType(), ShouldEqual, reflect.TypeOf(""))
+	})
+	Convey("FROM subqueries & UNION", t, func() {
+		cts := colTypes("SELECT * FROM (SELECT * FROM typed) AS x")
+		So(cts[0].ScanType(), ShouldEqual, reflect.TypeOf(0))
+		cts = colTypes("SELECT id AS v FROM typed UNION SELECT b AS v FROM src")
+		So(cts[0].ScanType(), ShouldEqual, reflect.TypeOf((*interface{})(nil)).Elem())
+	})
+}
+
+func Test_TagsDB(t *testing.T) {
+	type Customer struct {
+		CustomerID int    `db:"customer_id"`
+		FullName   string `db:"full_name"`
+		Secret     string `nodb:"-"`
+	}
+	Convey("INSERT & UPDATE by tagged names, sqlx reading them back", t, func() {
+		tbl := []Customer{{1, "Ann", "pw1"}, {2, "Bob", "pw2"}}
+		NewCatalog("tagsdb").Add("c", &tbl)
+		conn := sqlx.MustConnect("nodb", "tagsdb")
+
+		_, err := conn.Exec("INSERT INTO c (customer_id, full_name) VALUES (3, 'Cy')")
+		So(err, ShouldBeNil)
+		_, err = conn.Exec("UPDATE c SET full_name = 'Bea' WHERE customer_id = 2")
+		So(err, ShouldBeNil)
+		So(tbl, ShouldResemble, []Customer{{1, "Ann", "pw1"}, {2, "Bea", "pw2"}, {3, "Cy", ""}})
+
+		_, err = conn.Exec("UPDATE c SET secret = 'x'")
+		So(err, ShouldNotBeNil)
+
+		var got []Customer
+		So(conn.Select(&got, "SELECT * FROM c WHERE customer_id > 1"), ShouldBeNil)
+		So(got, ShouldResemble, []Customer{{2, "Bea", ""}, {3, "Cy", ""}})
+	})
+}
+
+func Test_NestedDB(t *testing.T) {
+	type Address struct{ City string }
+	type Person struct{ Name string }
+	type Order struct {
+		ID      int
+		Address Address
+		Manager *Person
+		Rank    *int
+	}
+	Convey("UPDATE nested value fields & pointer columns", t, func() {
+		ann := &Person{"Ann"}
+		tbl := []Order{{1, Address{"Oslo"}, ann, nil}, {2, Address{"Rome"}, nil, nil}}
+		NewCatalog("nesteddb").Add("o", &tbl)
+		conn := sqlx.MustConnect("nodb", "nesteddb")
+
+		_, err := conn.Exec("UPDATE o SET address.city = 'Bergen', rank = ? WHERE address.city = 'Oslo'", 7)
+		So(err, ShouldBeNil)
+		So(tbl[0].Address.City, ShouldEqual, "Bergen")
+		So(*tbl[0].Rank, ShouldEqual, 7)
+		So(tbl[1].Rank, ShouldBeNil)
+
+		_, err = conn.Exec("UPDATE o SET manager.name = 'Eve'")
+		So(err, ShouldNotBeNil) // row 2's manager is NULL
+		So(ann.Name, ShouldEqual, "Ann")
+		So(tbl[1].Manager, ShouldBeNil)
+
+		_, err = conn.Exec("UPDATE o SET manager.name = 'Eve' WHERE manager.name IS NOT NULL")
+		So(err, ShouldBeNil)
+		So(ann.Name, ShouldEqual, "Ann") // copied, not changed
+		So(tbl[0].Manager, ShouldResemble, &Person{"Eve"})
+		So(tbl[1].Manager, ShouldBeNil)
+
+		var ranks []sql.NullInt64
+		So(conn.Select(&ranks, "SELECT rank FROM o ORDER BY id"), ShouldBeNil)
+		So(ranks, ShouldResemble, []sql.NullInt64{{Int64: 7, Valid: true}, {}})
+	})
+	Convey("a table of pointers is changed by copying each row changed", t, func() {
+		one, two := &Order{ID: 1}, &Order{ID: 2}
+		tbl := []*Order{one, two}
+		NewCatalog("nestedptrdb").Add("o", &tbl)
+		conn := sqlx.MustConnect("nodb", "nestedptrdb")
+
+		res, err := conn.Exec("UPDATE o SET address.city = 'Oslo' WHERE id = 2")
+		So(err, ShouldBeNil)
+		n, _ := res.RowsAffected()
+		So(n, ShouldEqual, 1)
+		So(tbl[0], ShouldEqual, one)
+		So(tbl[1], ShouldNotEqual, two)
+		So(tbl[1].Address.City, ShouldEqual, "Oslo")
+		So(two.Address.City, ShouldEqual, "")
+
+		_, err = conn.Exec("INSERT INTO o (id) VALUES (3)")
+		So(err, ShouldBeNil)
+		_, err = conn.Exec("DELETE FROM o WHERE id = 1")
+		So(err, ShouldBeNil)
+		So(tbl, ShouldHaveLength, 2)
+		So(tbl[1], ShouldResemble, &Order{ID: 3})
+
+		var ids []int
+		So(conn.Select(&ids, "SELECT id FROM o WHERE address.city = 'Oslo'"), ShouldBeNil)
+		So(ids, ShouldResemble, []int{2})
+	})
+}
+
+func Test_TableDB(t *testing.T) {
+	Convey("a Table added to a catalog", t, func() {
+		NewCatalog("tabledb").Add("r", &ring{buf: []Foo{{1, "a"}, {2, "b"}}})
+		conn := sqlx.MustConnect("nodb", "tabledb")
+		type row struct {
+			A int    `db:"a"`
+			B string `db:"b"`
+		}
+		var got []row
+		So(conn.Select(&got, "SELECT a, b FROM r ORDER BY a DESC"), ShouldBeNil)
+		So(got, ShouldResemble, []row{{2, "b"}, {1, "a"}})
+
+		rows, err := conn.Query("SELECT b FROM r")
+		So(err, ShouldBeNil)
+		cts, err := rows.ColumnTypes()
+		So(err, ShouldBeNil)
+		So(cts[0].DatabaseTypeName(), ShouldEqual, "TEXT")
+		rows.Close()
+
+		_, err = conn.Exec("DELETE FROM r")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,79 @@
+package nodb
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/sel"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Plan is how a SELECT would run. Empty strings are stages not present.
+type Plan struct {
+	Tables   []PlanTable // in join order
+	Where    string      // WHERE parts checked after joining
+	GroupBy  string
+	Having   string
+	OrderBy  string
+	Distinct bool
+	Limit    string
+}
+
+// PlanTable is one table read by the query
+type PlanTable struct {
+	Name       string
+	Join       string   // "" for the first table, else "join" or "left join"
+	Strategy   string   // "scan", "nested loop", "hash" or "merge"
+	On         string   // the ON condition
+	Filter     string   // WHERE parts checked as each row is read, before joining
+	UsedFields []string // fields the query reads
+}
+
+// Explain the plan for a SELECT against 'src' without running it.
+// A leading EXPLAIN is optional.
+func Explain(query string, src Obj) (*Plan, error) {
+	query, _ = splitExplain(query)
+	tree, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	e, err := sel.Explain(tree, base.Obj(src))
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Where:    e.Where,
+		GroupBy:  e.GroupBy,
+		Having:   e.Having,
+		OrderBy:  e.OrderBy,
+		Distinct: e.Distinct,
+		Limit:    e.Limit,
+	}
+	for _, t := range e.Tables {
+		p.Tables = append(p.Tables, PlanTable(t))
+	}
+	return p, nil
+}
+
+// splitExplain removes a leading EXPLAIN, which the parser does not keep.
+func splitExplain(query string) (string, bool) {
+	trimmed := strings.TrimSpace(query)
+	if len(trimmed) > 7 && strings.EqualFold(trimmed[:7], "explain") && unicode.IsSpace(rune(trimmed[7])) {
+		return trimmed[8:], true
+	}
+	return query, false
+}
+
+func parseSelect(query string) (sqlparser.SelectStatement, error) {
+	tree, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := tree.(sqlparser.SelectStatement)
+	if !ok {
+		return nil, fmt.Errorf("Not a SELECT statement")
+	}
+	return s, nil
+}
@@ -0,0 +1,45 @@
+package base
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Assign puts v in f. NULL becomes the zero value. Numbers convert. A
+// pointer field gets a new pointer to v.
+func Assign(f reflect.Value, v interface{}) error {
+	if v == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Type().AssignableTo(f.Type()):
+		f.Set(rv)
+	case f.Kind() == reflect.Ptr && Assignable(rv.Type(), f.Type().Elem()):
+		p := reflect.New(f.Type().Elem())
+		if err := Assign(p.Elem(), v); err != nil {
+			return err
+		}
+		f.Set(p)
+	case Assignable(rv.Type(), f.Type()):
+		f.Set(rv.Convert(f.Type()))
+	default:
+		return fmt.Errorf("cannot put %T in a %s", v, f.Type())
+	}
+	return nil
+}
+
+// Assignable tells if Assign can put a value of type t in a dest
+func Assignable(t, dest reflect.Type) bool {
+	if dest.Kind() == reflect.Ptr && !t.AssignableTo(dest) {
+		dest = dest.Elem()
+	}
+	return t.AssignableTo(dest) ||
+		isNumber(t.Kind()) && isNumber(dest.Kind()) ||
+		t.Kind() == reflect.String && dest.Kind() == reflect.String
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
@@ -0,0 +1,21 @@
+package base
+
+import "reflect"
+
+// ColType is what a column's values will be, as known before any row is read
+type ColType struct {
+	Type      reflect.Type // nil when only the values can tell
+	Nullable  bool         // may be NULL
+	NullKnown bool         // Nullable can be trusted
+}
+
+// FieldColType is the ColType of a struct field of type t
+func FieldColType(t reflect.Type) ColType {
+	switch t.Kind() {
+	case reflect.Interface:
+		return ColType{}
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		return ColType{Type: t, Nullable: true, NullKnown: true}
+	}
+	return ColType{Type: t, NullKnown: true}
+}
@@ -0,0 +1,190 @@
+package base
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// StructColumn is a struct field seen as a column
+type StructColumn struct {
+	Name  string // as SQL sees it
+	Index []int  // for ColumnValue: field numbers, pointers followed between
+	Type  reflect.Type
+}
+
+// ColumnName is the column a struct field is: its nodb tag, else its db tag
+// (as sqlx reads it), else its Go name. ok is false for a "-" tag.
+func ColumnName(f reflect.StructField) (name string, ok bool) {
+	name, _, ok = tagName(f)
+	if name == "" {
+		name = f.Name
+	}
+	return name, ok
+}
+
+// tagName is the name from a field's nodb or db tag, if any
+func tagName(f reflect.StructField) (name string, tagged, ok bool) {
+	for _, key := range []string{"nodb", "db"} {
+		if tag, found := f.Tag.Lookup(key); found {
+			name = strings.Split(tag, ",")[0]
+			if name == "-" {
+				return "", true, false
+			}
+			if name != "" {
+				return name, true, true
+			}
+		}
+	}
+	return "", false, true
+}
+
+// StructColumns lists the columns of struct type t, including those promoted
+// from untagged embedded structs unless t's own fields shadow them.
+// Unexported fields are left out but reported by hasPrivate; "-" tagged
+// ones are just left out.
+func StructColumns(t reflect.Type) (cols []StructColumn, hasPrivate bool) {
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	seen := map[string]bool{}
+	var promoted []StructColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, tagged, ok := tagName(f)
+		if !ok {
+			continue
+		}
+		if f.Anonymous && !tagged {
+			if sub, private := StructColumns(derefType(f.Type)); len(sub) > 0 {
+				hasPrivate = hasPrivate || private
+				for _, c := range sub {
+					c.Index = append([]int{i}, c.Index...)
+					promoted = append(promoted, c)
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			hasPrivate = true
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		seen[strings.ToLower(name)] = true
+		cols = append(cols, StructColumn{Name: name, Index: []int{i}, Type: f.Type})
+	}
+	for _, c := range promoted {
+		if !seen[strings.ToLower(c.Name)] {
+			seen[strings.ToLower(c.Name)] = true
+			cols = append(cols, c)
+		}
+	}
+	return cols, hasPrivate
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// SubColumn finds a column of t, or of the struct t points to, ignoring case
+func SubColumn(t reflect.Type, name string) (StructColumn, bool) {
+	if t == nil {
+		return StructColumn{}, false
+	}
+	cols, _ := StructColumns(derefType(t))
+	for _, c := range cols {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return StructColumn{}, false
+}
+
+// ColumnPath finds column key in struct type t. Nested fields have dotted
+// keys of real-cased column names, like "Address.City".
+func ColumnPath(t reflect.Type, key string) ([]int, bool) {
+	cols, _ := StructColumns(derefType(t))
+	for _, c := range cols {
+		if c.Name == key { // even if it has dots
+			return c.Index, true
+		}
+	}
+	var path []int
+	for _, name := range strings.Split(key, ".") {
+		c, ok := SubColumn(t, name)
+		if !ok {
+			return nil, false
+		}
+		path = append(path, c.Index...)
+		t = c.Type
+	}
+	return path, true
+}
+
+// ColumnValue reads the field at path in struct row. A nil pointer on the
+// way, or at the end, is NULL; pointers to non-structs are followed, as are
+// interfaces on the way. Pointers to structs stay pointers.
+func ColumnValue(row reflect.Value, path []int) interface{} {
+	for _, i := range path {
+		for row.Kind() == reflect.Ptr || row.Kind() == reflect.Interface {
+			if row.IsNil() {
+				return nil
+			}
+			row = row.Elem()
+		}
+		row = row.Field(i)
+	}
+	if row.Kind() == reflect.Ptr {
+		if row.IsNil() {
+			return nil // not a typed nil, which IS NULL would miss
+		}
+		if row.Type().Elem().Kind() != reflect.Struct {
+			row = row.Elem()
+		}
+	}
+	return row.Interface()
+}
+
+// columnPaths finds, and remembers, where a struct type keeps each column
+type columnPaths struct {
+	t     reflect.Type
+	paths sync.Map // key -> []int
+}
+
+func newColumnPaths(t reflect.Type) *columnPaths {
+	return &columnPaths{t: derefType(t)}
+}
+
+// value reads column key from row, a struct of type t
+func (c *columnPaths) value(row reflect.Value, key string) interface{} {
+	p, ok := c.paths.Load(key)
+	if !ok {
+		path, _ := ColumnPath(c.t, key)
+		p, _ = c.paths.LoadOrStore(key, path)
+	}
+	return ColumnValue(row, p.([]int))
+}
+
+// RowType is the struct type a slice or chan table's rows are, through
+// pointers. A slice of interfaces is taken to hold one type, found from
+// its first non-nil row. nil for rows that aren't structs.
+func RowType(table reflect.Value) reflect.Type {
+	t := derefType(table.Type().Elem())
+	if t.Kind() == reflect.Interface && table.Kind() == reflect.Slice {
+		for i := 0; i < table.Len(); i++ {
+			if e := table.Index(i).Elem(); e.IsValid() {
+				t = derefType(e.Type())
+				break
+			}
+		}
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
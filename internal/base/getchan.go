@@ -1,5 +1,7 @@
 package base
 
+import "strings"
+
 // GetChanError is the GetChan return type
 type GetChanError struct {
 	Item []interface{}
@@ -8,3 +10,16 @@ type GetChanError struct {
 
 // Obj conveys "table data" as Do's 3rd arg
 type Obj map[string]interface{}
+
+// Table finds a table by its parsed (lowercased) name
+func (o Obj) Table(name string) (interface{}, bool) {
+	if t, ok := o[name]; ok {
+		return t, true
+	}
+	for k, t := range o { // work around auto-lowercase of tablename
+		if strings.ToLower(k) == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,72 @@
+package base
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// HashKey makes a map key of values that are equal when SQL compares them
+// equal: all numbers (and times, as UnixNano) become float64.
+// ok is false when a value is NULL (or NaN), as that equals nothing.
+func HashKey(vals []interface{}) (key string, ok bool, err error) {
+	var b []byte
+	for _, v := range vals {
+		n, ok := NormalizeKey(v)
+		if !ok {
+			return "", false, nil
+		}
+		if b, err = appendKey(b, n); err != nil {
+			return "", false, err
+		}
+	}
+	return string(b), true, nil
+}
+
+// appendKey adds one normalized value to a key. Each kind gets its own
+// prefix and a form that shows where it ends, so no two lists share a key.
+// JSON is kept for the rest, as it can't hold ±Inf.
+func appendKey(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case float64:
+		if v == 0 {
+			v = 0 // -0 = 0
+		}
+		b = strconv.AppendFloat(append(b, 'f'), v, 'g', -1, 64)
+	case string:
+		b = strconv.AppendQuote(append(b, 's'), v)
+	case bool:
+		b = strconv.AppendBool(append(b, 'b'), v)
+	default:
+		j, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b = strconv.AppendInt(append(b, 'j'), int64(len(j)), 10)
+		b = append(append(b, ':'), j...)
+	}
+	return append(b, ','), nil
+}
+
+// NormalizeKey is one value as HashKey sees it
+func NormalizeKey(v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	if t, ok := v.(time.Time); ok {
+		return float64(t.UnixNano()), true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		return f, !math.IsNaN(f)
+	}
+	return v, true
+}
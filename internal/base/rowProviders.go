@@ -1,21 +1,31 @@
 package base
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 )
 
 type SliceOfStructRowProvider struct {
 	t          reflect.Value
+	cols       *columnPaths
 	length     int
 	currentRow int
 	started    bool // first .Next() and each-loop .Next() is called 1x too much
 }
 
+// NewSliceOfStructRP reads a slice of structs, of pointers to them (a nil
+// one is a row of NULLs) or of interfaces holding one struct type.
 func NewSliceOfStructRP(sliceOfStruct interface{}) RowProvider {
 	v := reflect.ValueOf(sliceOfStruct)
+	t := RowType(v)
+	if t == nil {
+		t = v.Type().Elem()
+	}
 	return &SliceOfStructRowProvider{
 		t:          v,
+		cols:       newColumnPaths(t),
 		length:     v.Len(),
 		currentRow: 0,
 	}
@@ -27,6 +37,9 @@ func (s *SliceOfStructRowProvider) GetInfo() (multiPassCost int) {
 
 func (s *SliceOfStructRowProvider) SetConfig(multiPass bool) {}
 func (s *SliceOfStructRowProvider) NextRow() (hasNotLooped bool) {
+	if s.length == 0 {
+		return false
+	}
 	if !s.started {
 		s.started = true
 		return true
@@ -39,14 +52,99 @@ func (s *SliceOfStructRowProvider) NextRow() (hasNotLooped bool) {
 }
 func (s *SliceOfStructRowProvider) GetFields(used map[string]bool, addPrefix string, dest map[string]interface{}) error {
 	myrow := s.t.Index(s.currentRow) // TODO interface this to allow other tables / locks
-	for name := range used {         // copy my useful fields
-		dest[addPrefix+name] = myrow.FieldByName(name).Interface()
+	if myrow.Kind() == reflect.Interface && !myrow.IsNil() && derefType(myrow.Elem().Type()) != s.cols.t {
+		return fmt.Errorf("row %d is a %s, not a %s", s.currentRow, myrow.Elem().Type(), s.cols.t)
+	}
+	for name := range used { // copy my useful fields
+		dest[addPrefix+name] = s.cols.value(myrow, name)
 	}
 	return nil
 }
 
+// SliceOfMapRowProvider reads []map[string]interface{}. Missing keys are NULL.
+type SliceOfMapRowProvider struct {
+	t          []map[string]interface{}
+	currentRow int
+	started    bool // as in SliceOfStructRowProvider
+}
+
+func NewSliceOfMapRP(rows []map[string]interface{}) RowProvider {
+	return &SliceOfMapRowProvider{t: rows}
+}
+
+func (s *SliceOfMapRowProvider) GetInfo() (multiPassCost int) {
+	return 3 // a hash lookup per field
+}
+
+func (s *SliceOfMapRowProvider) SetConfig(multiPass bool) {}
+func (s *SliceOfMapRowProvider) NextRow() (hasNotLooped bool) {
+	if len(s.t) == 0 {
+		return false
+	}
+	if !s.started {
+		s.started = true
+		return true
+	}
+	s.currentRow = (s.currentRow + 1) % len(s.t)
+	if s.currentRow == 0 {
+		s.started = false
+	}
+	return s.currentRow != 0
+}
+func (s *SliceOfMapRowProvider) GetFields(used map[string]bool, addPrefix string, dest map[string]interface{}) error {
+	myrow := s.t[s.currentRow]
+	for name := range used {
+		dest[addPrefix+name] = myrow[name]
+	}
+	return nil
+}
+
+// MapColumns finds the columns of map rows: every key any row has, sorted.
+// A column's type is known if all its values share one.
+func MapColumns(rows []map[string]interface{}) ([]string, map[string]ColType) {
+	types := map[string]ColType{}
+	mixed := map[string]bool{}
+	for _, r := range rows {
+		for k, v := range r {
+			ct := types[k]
+			switch {
+			case v == nil:
+				ct.Nullable = true
+			case mixed[k]:
+			case ct.Type == nil:
+				ct.Type = reflect.TypeOf(v)
+			case ct.Type != reflect.TypeOf(v):
+				ct.Type, mixed[k] = nil, true
+			}
+			types[k] = ct
+		}
+	}
+	cols := make([]string, 0, len(types))
+	for k, ct := range types {
+		cols = append(cols, k)
+		for _, r := range rows {
+			if _, ok := r[k]; !ok {
+				ct.Nullable = true
+				break
+			}
+		}
+		ct.NullKnown = true // every row was read
+		types[k] = ct
+	}
+	sort.Strings(cols)
+	return cols, types
+}
+
+// MapTable is a []map[string]interface{} table with its columns declared,
+// rather than found by reading every row.
+type MapTable struct {
+	Table   interface{}
+	Columns []string
+}
+
 type ChanOfStructRowProvider struct {
 	t              reflect.Value
+	cols           *columnPaths
 	init           bool
 	currentRow     int
 	currentRowVal  reflect.Value // during channel walk its set by nextrow
@@ -61,6 +159,7 @@ func NewChanOfStructRP(chanOfStruct interface{}) RowProvider {
 	v := reflect.ValueOf(chanOfStruct)
 	return &ChanOfStructRowProvider{
 		t:              v,
+		cols:           newColumnPaths(v.Type().Elem()),
 		currentRow:     0,
 		channelReading: true,
 	}
@@ -114,7 +213,7 @@ func (c *ChanOfStructRowProvider) GetFields(used map[string]bool, addPrefix stri
 		c.currentRowVal = c.Saved[c.currentRow]
 	}
 	for name := range used { // copy my useful fields
-		dest[addPrefix+name] = c.currentRowVal.FieldByName(name).Interface()
+		dest[addPrefix+name] = c.cols.value(c.currentRowVal, name)
 	}
 	c.Lock()
 	defer c.Unlock()
@@ -130,3 +229,53 @@ func (c *ChanOfStructRowProvider) SetError(e error) {
 type CanSetError interface {
 	SetError(e error)
 }
+
+// CanClose is a RowProvider holding something to let go of when its reader
+// is done, however the query ended
+type CanClose interface {
+	Close() error
+}
+
+// SortKey is a field that a table's rows are ordered by.
+type SortKey struct {
+	Field string // real case
+	Desc  bool
+}
+
+// SortedRowProvider is a RowProvider that knows the order of its rows.
+// The planner uses it for single-pass merge joins.
+type SortedRowProvider interface {
+	RowProvider
+	SortedBy() []SortKey
+}
+
+type sortedRowProvider struct {
+	RowProvider
+	by []SortKey
+}
+
+func NewSortedRP(rp RowProvider, by []SortKey) RowProvider {
+	return &sortedRowProvider{RowProvider: rp, by: by}
+}
+
+func (s *sortedRowProvider) SortedBy() []SortKey { return s.by }
+
+func (s *sortedRowProvider) SetError(e error) {
+	if ce, ok := s.RowProvider.(CanSetError); ok {
+		ce.SetError(e)
+	}
+}
+
+func (s *sortedRowProvider) Close() error {
+	if c, ok := s.RowProvider.(CanClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// SortedTable wraps a table (slice or chan) whose rows are already ordered.
+// By holds field names, each optionally followed by " DESC".
+type SortedTable struct {
+	Table interface{}
+	By    []string
+}
@@ -2,6 +2,7 @@ package base
 
 import (
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 )
@@ -18,7 +19,18 @@ type SrcTable struct {
 	Fields           []string        // All public fields, real case
 	UsedFields       map[string]bool // Fields actually consumed, real case
 	Name             string
-	HasPrivateFields bool // Cannot copy these. Query/filter/result cannot ref them.
+	HasPrivateFields bool               // Cannot copy these. Query/filter/result cannot ref them.
+	FieldTypes       map[string]ColType // by Fields entry
+	Nullable         bool               // LEFT JOINed: any field may be NULL
+}
+
+// FieldType is the ColType of one of Fields
+func (t *SrcTable) FieldType(field string) ColType {
+	ct, ok := t.FieldTypes[field]
+	if ok && t.Nullable {
+		ct.Nullable = true
+	}
+	return ct
 }
 
 type SrcTables map[string]*SrcTable
@@ -60,16 +72,28 @@ func (ts *SrcTables) sortedKeys() (s []string) {
 	return
 }
 
+// resolveRef finds a field, or with more pcs a field nested inside it, and
+// returns its real-cased, dotted name
 func (t *SrcTable) resolveRef(pcs []string) (string, error) {
 	for _, f := range t.Fields {
-		lowf := strings.ToLower(f)
-		if lowf == pcs[0] {
-			if len(pcs) > 1 {
-				return "", fmt.Errorf("Ref into structs not impl, TODO")
+		if strings.ToLower(f) != pcs[0] {
+			continue
+		}
+		name, ct := f, t.FieldTypes[f]
+		for _, p := range pcs[1:] {
+			c, ok := SubColumn(ct.Type, p)
+			if !ok {
+				return "", fmt.Errorf("Column %s has no field %s", name, p)
 			}
-			t.UsedFields[f] = true
-			return f, nil
+			nullable := ct.Nullable || ct.Type.Kind() == reflect.Ptr
+			name, ct = name+"."+c.Name, FieldColType(c.Type)
+			ct.Nullable = ct.Nullable || nullable
+		}
+		if _, ok := t.FieldTypes[name]; !ok && t.FieldTypes != nil {
+			t.FieldTypes[name] = ct
 		}
+		t.UsedFields[name] = true
+		return name, nil
 	}
 	return "", nil
 }
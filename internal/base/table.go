@@ -0,0 +1,128 @@
+package base
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Table is a table source of one's own, such as a B-tree or a cache, to
+// query without copying it into a slice.
+type Table interface {
+	// Columns is the schema. It must not change while a query runs.
+	Columns() []Column
+	// Open starts a pass over every row. A query may make several passes
+	// (the inner side of a join). One stopped early is still Closed.
+	Open() (Cursor, error)
+}
+
+// Column is one column of a Table
+type Column struct {
+	Name     string
+	Type     reflect.Type // of its values; nil if unknown or mixed
+	Nullable bool         // may be nil
+}
+
+// Cursor walks a Table's rows, like driver.Rows
+type Cursor interface {
+	// Next fills dest, one value per column, or returns io.EOF after the last row.
+	Next(dest []interface{}) error
+	Close() error
+}
+
+// TableRowProvider reads a Table, opening a Cursor per pass
+type TableRowProvider struct {
+	t     Table
+	index map[string]int // column -> place in row
+	cur   Cursor
+	row   []interface{}
+	err   error
+}
+
+// NewTableRP reads t, whose Columns were cols when the query was planned
+func NewTableRP(t Table, cols []Column) RowProvider {
+	p := &TableRowProvider{t: t, index: make(map[string]int, len(cols)), row: make([]interface{}, len(cols))}
+	for i, c := range cols {
+		p.index[c.Name] = i
+	}
+	return p
+}
+
+func (p *TableRowProvider) GetInfo() (multiPassCost int) {
+	return 5 // unknown: somewhere between a slice and a channel
+}
+
+func (p *TableRowProvider) SetConfig(multiPass bool) {}
+
+// NextRow reads a row. An error counts as a row, for GetFields to report.
+func (p *TableRowProvider) NextRow() (hasNotLooped bool) {
+	if p.err != nil {
+		return false
+	}
+	if p.cur == nil {
+		if p.cur, p.err = p.t.Open(); p.err != nil {
+			return true
+		}
+	}
+	for i := range p.row {
+		p.row[i] = nil
+	}
+	switch err := p.cur.Next(p.row); err {
+	case nil:
+		return true
+	case io.EOF:
+		p.err = p.cur.Close()
+		p.cur = nil
+		return p.err != nil
+	default:
+		p.cur.Close()
+		p.cur, p.err = nil, err
+		return true
+	}
+}
+
+func (p *TableRowProvider) GetFields(used map[string]bool, addPrefix string, dest map[string]interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	for name := range used {
+		v, err := p.value(name)
+		if err != nil {
+			return err
+		}
+		dest[addPrefix+name] = v
+	}
+	return nil
+}
+
+// value reads a column, or a field nested in one as "col.Field"
+func (p *TableRowProvider) value(name string) (interface{}, error) {
+	if i, ok := p.index[name]; ok {
+		return p.row[i], nil
+	}
+	col, rest, _ := strings.Cut(name, ".")
+	i, ok := p.index[col]
+	if !ok {
+		return nil, fmt.Errorf("table has no column %s", col)
+	}
+	v := p.row[i]
+	if v == nil {
+		return nil, nil
+	}
+	path, ok := ColumnPath(reflect.TypeOf(v), rest)
+	if !ok {
+		return nil, fmt.Errorf("column %s has no field %s", col, rest)
+	}
+	return ColumnValue(reflect.ValueOf(v), path), nil
+}
+
+// Close closes a Cursor left open by a pass that stopped early
+func (p *TableRowProvider) Close() error {
+	if p.cur == nil {
+		return nil
+	}
+	err := p.cur.Close()
+	p.cur = nil
+	return err
+}
@@ -0,0 +1,378 @@
+// Package dml changes tables: INSERT, UPDATE and DELETE.
+package dml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/expr"
+	"github.com/snadrus/nodb/internal/sel"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Do runs an INSERT, UPDATE or DELETE, returning how many rows it changed.
+// Tables must be pointers to slices of structs, or of pointers to them. The
+// slice is replaced, not changed in place, and so is any struct reached by
+// pointer before it is changed. So queries already reading the table are not
+// disturbed and a failing or cancelled statement changes nothing.
+func Do(stmt sqlparser.Statement, src base.Obj, ctx context.Context) (int64, error) {
+	switch s := stmt.(type) {
+	case *sqlparser.Insert:
+		return insert(s, src, ctx)
+	case *sqlparser.Update:
+		return update(s, src, ctx)
+	case *sqlparser.Delete:
+		return del(s, src, ctx)
+	}
+	return 0, fmt.Errorf("Query type not supported")
+}
+
+// table is a working copy of a table being changed
+type table struct {
+	ptr  reflect.Value // *[]struct or *[]*struct as added
+	rows reflect.Value // our copy of *ptr
+	unit reflect.Type  // the struct
+	src  base.SrcTable
+	cols map[string][]int // column -> field path
+	b    *expr.ExpressionBuilder
+	run  *expr.Run // what b's expressions read
+}
+
+func open(tn *sqlparser.TableName, src base.Obj, ctx context.Context) (*table, error) {
+	name := string(tn.Name) // already lowercased
+	tdata, ok := src.Table(name)
+	if !ok {
+		return nil, fmt.Errorf("missing table %s", tn.Name)
+	}
+	ptr := reflect.ValueOf(tdata)
+	var unit reflect.Type
+	if ptr.Kind() == reflect.Ptr && ptr.Elem().Kind() == reflect.Slice {
+		unit = ptr.Elem().Type().Elem()
+		if unit.Kind() == reflect.Ptr {
+			unit = unit.Elem()
+		}
+	}
+	if unit == nil || unit.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("table %s must be added as a pointer to a slice of structs to change it", name)
+	}
+	old := ptr.Elem()
+	t := &table{
+		ptr:  ptr,
+		rows: reflect.MakeSlice(old.Type(), old.Len(), old.Len()),
+		unit: unit,
+		src:  base.SrcTable{Name: name, UsedFields: map[string]bool{}},
+	}
+	reflect.Copy(t.rows, old)
+	cols, hasPrivate := base.StructColumns(unit)
+	t.cols = make(map[string][]int, len(cols))
+	t.src.FieldTypes = make(map[string]base.ColType, len(cols))
+	for _, c := range cols {
+		t.src.Fields = append(t.src.Fields, c.Name)
+		t.src.FieldTypes[c.Name] = base.FieldColType(c.Type)
+		t.cols[c.Name] = c.Index
+	}
+	t.src.HasPrivateFields = hasPrivate
+	t.b = expr.DefaultBuilder.Dup().Setup(base.SrcTables{name: &t.src}, src, sel.SubqueryRunnerImpl{})
+	t.run = &expr.Run{Obj: src, Ctx: ctx}
+	return t, nil
+}
+
+// field finds the struct field a column names
+func (t *table) field(c *sqlparser.ColName) (string, error) {
+	ref := string(c.Name)
+	if len(c.Qualifier) != 0 {
+		ref = string(c.Qualifier) + "." + ref
+	}
+	v, err := t.b.ResolveRefAndMarkUsed(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(v, t.src.Name+"."), nil
+}
+
+// path finds a column's field, nested or not
+func (t *table) path(name string) []int {
+	p, ok := t.cols[name]
+	if !ok {
+		p, _ = base.ColumnPath(t.unit, name)
+		t.cols[name] = p
+	}
+	return p
+}
+
+// settable is the field for column name in r, a struct of our own. Structs
+// behind pointers are shared with the table as added, so r gets a copy of
+// each on the way. A nil pointer is NULL, whose fields an UPDATE can't set;
+// an INSERT, making the row, makes the struct too.
+func (t *table) settable(r reflect.Value, name string, insert bool) (reflect.Value, error) {
+	for _, i := range t.path(name) {
+		if r.Kind() == reflect.Ptr {
+			if r.IsNil() && !insert {
+				return reflect.Value{}, errors.New("cannot set a field of a NULL")
+			}
+			r.Set(clone(r))
+			r = r.Elem()
+		}
+		r = r.Field(i)
+	}
+	return r, nil
+}
+
+// clone is a pointer to a copy of what p points to, or to a zero value
+func clone(p reflect.Value) reflect.Value {
+	c := reflect.New(p.Type().Elem())
+	if !p.IsNil() {
+		c.Elem().Set(p.Elem())
+	}
+	return c
+}
+
+// own is row i, made ours to change: a copy if the table holds pointers.
+// A nil row is all NULLs, with nothing to change.
+func (t *table) own(i int) (reflect.Value, error) {
+	r := t.rows.Index(i)
+	if r.Kind() == reflect.Ptr {
+		if r.IsNil() {
+			return reflect.Value{}, fmt.Errorf("cannot change row %d, which is nil", i)
+		}
+		r.Set(clone(r))
+		r = r.Elem()
+	}
+	return r, nil
+}
+
+// row i as expressions see it. Build expressions first so UsedFields is known.
+func (t *table) row(i int) map[string]interface{} {
+	r := t.rows.Index(i)
+	row := t.run.Row()
+	for name := range t.src.UsedFields {
+		row[t.src.Name+"."+name] = base.ColumnValue(r, t.path(name))
+	}
+	return row
+}
+
+// where builds the row filter. NULL and false both skip the row.
+func (t *table) where(w *sqlparser.Where) (func(map[string]interface{}) (bool, error), error) {
+	if w == nil {
+		return func(map[string]interface{}) (bool, error) { return true, nil }, nil
+	}
+	cond, err := t.b.MakeBool(w.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]interface{}) (bool, error) {
+		v, err := cond(row)
+		b, _ := v.(bool)
+		return b, err
+	}, nil
+}
+
+// commit puts our copy in place if it changed any rows
+func (t *table) commit(n int64) {
+	if n > 0 {
+		t.ptr.Elem().Set(t.rows)
+	}
+}
+
+// limit is the most rows to change, or -1 for all
+func limit(orderBy sqlparser.OrderBy, l *sqlparser.Limit) (int64, error) {
+	if orderBy != nil {
+		return 0, errors.New("No support for ORDER BY in UPDATE or DELETE")
+	}
+	if l == nil {
+		return -1, nil
+	}
+	offset, rowCount, err := l.Limits()
+	if err != nil {
+		return 0, err
+	}
+	if offset != nil {
+		return 0, errors.New("No support for a LIMIT offset in UPDATE or DELETE")
+	}
+	n, _ := rowCount.(int64)
+	return n, nil
+}
+
+func update(s *sqlparser.Update, src base.Obj, ctx context.Context) (int64, error) {
+	t, err := open(s.Table, src, ctx)
+	if err != nil {
+		return 0, err
+	}
+	type set struct {
+		field string
+		val   expr.E
+	}
+	sets := make([]set, len(s.Exprs))
+	for i, ue := range s.Exprs {
+		if sets[i].field, err = t.field(ue.Name); err != nil {
+			return 0, err
+		}
+		if sets[i].val, err = t.b.MakeVal(ue.Expr); err != nil {
+			return 0, err
+		}
+	}
+	match, err := t.where(s.Where)
+	if err != nil {
+		return 0, err
+	}
+	max, err := limit(s.OrderBy, s.Limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	vals := make([]interface{}, len(sets))
+	for i := 0; i < t.rows.Len() && n != max; i++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		row := t.row(i)
+		if ok, err := match(row); err != nil {
+			return 0, err
+		} else if !ok {
+			continue
+		}
+		for j, st := range sets { // all from the old row, then all set
+			if vals[j], err = st.val(row); err != nil {
+				return 0, err
+			}
+		}
+		r, err := t.own(i)
+		if err != nil {
+			return 0, err
+		}
+		for j, st := range sets {
+			f, err := t.settable(r, st.field, false)
+			if err == nil {
+				err = base.Assign(f, vals[j])
+			}
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", st.field, err.Error())
+			}
+		}
+		n++
+	}
+	t.commit(n)
+	return n, nil
+}
+
+func del(s *sqlparser.Delete, src base.Obj, ctx context.Context) (int64, error) {
+	t, err := open(s.Table, src, ctx)
+	if err != nil {
+		return 0, err
+	}
+	match, err := t.where(s.Where)
+	if err != nil {
+		return 0, err
+	}
+	max, err := limit(s.OrderBy, s.Limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	kept := reflect.MakeSlice(t.rows.Type(), 0, t.rows.Len())
+	for i := 0; i < t.rows.Len(); i++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if n != max {
+			ok, err := match(t.row(i))
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				n++
+				continue
+			}
+		}
+		kept = reflect.Append(kept, t.rows.Index(i))
+	}
+	t.rows = kept
+	t.commit(n)
+	return n, nil
+}
+
+func insert(s *sqlparser.Insert, src base.Obj, ctx context.Context) (int64, error) {
+	t, err := open(s.Table, src, ctx)
+	if err != nil {
+		return 0, err
+	}
+	if s.OnDup != nil {
+		return 0, errors.New("No support for ON DUPLICATE KEY: tables have no keys")
+	}
+	fields := t.src.Fields
+	if s.Columns != nil {
+		fields = make([]string, len(s.Columns))
+		for i, c := range s.Columns {
+			var col *sqlparser.ColName
+			if nse, ok := c.(*sqlparser.NonStarExpr); ok {
+				col, _ = nse.Expr.(*sqlparser.ColName)
+			}
+			if col == nil {
+				return 0, fmt.Errorf("INSERT column %s is not a field", sqlparser.String(c))
+			}
+			if fields[i], err = t.field(col); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var rows [][]interface{}
+	switch r := s.Rows.(type) {
+	case sqlparser.Values:
+		for _, tuple := range r {
+			vt, ok := tuple.(sqlparser.ValTuple)
+			if !ok {
+				return 0, fmt.Errorf("INSERT row %s must be a list of values", sqlparser.String(tuple))
+			}
+			vals, err := t.b.MakeSlice(vt)
+			if err != nil {
+				return 0, err
+			}
+			v, err := vals(t.run.Row())
+			if err != nil {
+				return 0, err
+			}
+			rows = append(rows, v.([]interface{}))
+		}
+	case sqlparser.SelectStatement: // read it all before adding, it may read this table
+		ch, _ := sel.GetChan(r, src, ctx)
+		for v := range ch {
+			if v.Err != nil {
+				return 0, v.Err
+			}
+			rows = append(rows, v.Item)
+		}
+	}
+
+	if err := ctx.Err(); err != nil { // the SELECT may have stopped early
+		return 0, err
+	}
+	for _, vals := range rows {
+		if len(vals) != len(fields) {
+			return 0, fmt.Errorf("INSERT has %d columns but %d values", len(fields), len(vals))
+		}
+		r := reflect.New(t.unit)
+		for i, name := range fields {
+			f, err := t.settable(r.Elem(), name, true)
+			if err == nil {
+				err = base.Assign(f, vals[i])
+			}
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+		if t.rows.Type().Elem().Kind() == reflect.Ptr {
+			t.rows = reflect.Append(t.rows, r)
+		} else {
+			t.rows = reflect.Append(t.rows, r.Elem())
+		}
+	}
+	t.commit(int64(len(rows)))
+	return int64(len(rows)), nil
+}
@@ -2,6 +2,7 @@ package expr
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/Knetic/govaluate"
@@ -20,13 +21,28 @@ func (e *ExpressionBuilder) binaryExpr(tree *sqlparser.BinaryExpr) (E, error) {
 	}
 
 	// 100% perfect match for all math operators. Neat!
-	ee, err := govaluate.NewEvaluableExpression("l " + string(tree.Operator) + " r")
+	ee, err := opExpr(string(tree.Operator))
 	if err != nil {
 		return nil, err
 	}
 	return doBinOp(l, ee, r), err
 }
 
+var opExprs sync.Map // operator -> *govaluate.EvaluableExpression
+
+// opExpr is "l <op> r", parsed once per operator and shared by every query
+func opExpr(op string) (*govaluate.EvaluableExpression, error) {
+	if ee, ok := opExprs.Load(op); ok {
+		return ee.(*govaluate.EvaluableExpression), nil
+	}
+	ee, err := govaluate.NewEvaluableExpression("l " + op + " r")
+	if err != nil {
+		return nil, err
+	}
+	opExprs.Store(op, ee)
+	return ee, nil
+}
+
 func doBinOp(l E, op *govaluate.EvaluableExpression, r E) E { // candidate for govaluate
 	return func(row map[string]interface{}) (val interface{}, err error) {
 		left, err := l(row)
@@ -1,7 +1,6 @@
 package expr
 
 import (
-	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -47,11 +46,11 @@ func (e *ExpressionBuilder) MakeBool(tree sqlparser.BoolExpr) (E, error) {
 	case *sqlparser.ComparisonExpr:
 		return e.MakeCompare(tree.(*sqlparser.ComparisonExpr))
 	case *sqlparser.RangeCond:
-		return nil, errors.New("RANGE not impl, TODO")
+		return e.makeRange(tree.(*sqlparser.RangeCond))
 	case *sqlparser.NullCheck:
-		return nil, errors.New("IS NULL not impl, TODO")
+		return e.makeNullCheck(tree.(*sqlparser.NullCheck))
 	case *sqlparser.ExistsExpr:
-		return nil, errors.New("EXISTS not impl, TODO")
+		return e.makeExists(tree.(*sqlparser.ExistsExpr))
 	default:
 		return nil, fmt.Errorf("Unknown Expr")
 	}
@@ -63,7 +62,14 @@ func (e *ExpressionBuilder) MakeCompare(tree *sqlparser.ComparisonExpr) (E, erro
 	if err != nil {
 		return nil, err
 	}
-	right, err2 := e.MakeVal(tree.Right)
+	var right E
+	var err2 error
+	if sq, ok := tree.Right.(*sqlparser.Subquery); ok &&
+		(tree.Operator == sqlparser.AST_IN || tree.Operator == sqlparser.AST_NOT_IN) {
+		right, err2 = e.SubqueryToList(sq) // a list, not a value
+	} else {
+		right, err2 = e.MakeVal(tree.Right)
+	}
 	if err2 != nil {
 		return nil, err2
 	}
@@ -97,7 +103,7 @@ func (e *ExpressionBuilder) MakeCompare(tree *sqlparser.ComparisonExpr) (E, erro
 		return nil, fmt.Errorf("Unrecognized comparison")
 	}
 
-	ee, err := govaluate.NewEvaluableExpression("l " + op + " r")
+	ee, err := opExpr(op)
 	if err != nil {
 		return nil, err
 	}
@@ -105,6 +111,51 @@ func (e *ExpressionBuilder) MakeCompare(tree *sqlparser.ComparisonExpr) (E, erro
 	return doBinOp(left, ee, right), err
 }
 
+// makeRange does x [NOT] BETWEEN a AND b as a <= x AND x <= b
+func (e *ExpressionBuilder) makeRange(tree *sqlparser.RangeCond) (E, error) {
+	x, err := e.MakeVal(tree.Left)
+	if err != nil {
+		return nil, err
+	}
+	from, err := e.MakeVal(tree.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := e.MakeVal(tree.To)
+	if err != nil {
+		return nil, err
+	}
+	ge, err := opExpr(">=")
+	if err != nil {
+		return nil, err
+	}
+	le, err := opExpr("<=")
+	if err != nil {
+		return nil, err
+	}
+	between := makeAnd(doBinOp(x, ge, from), doBinOp(x, le, to))
+	if tree.Operator == sqlparser.AST_NOT_BETWEEN {
+		return makeNot(between), nil
+	}
+	return between, nil
+}
+
+// makeNullCheck does IS [NOT] NULL, the only test that is never NULL itself
+func (e *ExpressionBuilder) makeNullCheck(tree *sqlparser.NullCheck) (E, error) {
+	v, err := e.MakeVal(tree.Expr)
+	if err != nil {
+		return nil, err
+	}
+	wantNull := tree.Operator == sqlparser.AST_IS_NULL
+	return func(row map[string]interface{}) (interface{}, error) {
+		val, err := v(row)
+		if err != nil {
+			return nil, err
+		}
+		return (val == nil) == wantNull, nil
+	}, nil
+}
+
 // Translate an SQL LIKE to a REGEX
 func likeExpr(e E) E {
 	return func(row map[string]interface{}) (interface{}, error) {
@@ -140,8 +191,13 @@ func contains(sliceE, itemE E) E {
 			return nil, fmt.Errorf("Incorrect RHS for IN clause: %v", slice)
 		}
 		length := rs.Len()
+		sawNull := false
 		for a := 0; a < length; a++ {
 			rsIntf := rs.Index(a).Interface()
+			if rsIntf == nil {
+				sawNull = true
+				continue
+			}
 
 			v, err := eq.Evaluate(map[string]interface{}{"l": rsIntf, "r": item})
 			if (err == nil && v.(bool)) || reflect.DeepEqual(rsIntf, item) {
@@ -150,6 +206,9 @@ func contains(sliceE, itemE E) E {
 		}
 		// TODO reuse map if slice is constant
 
+		if sawNull { // x IN (.., NULL) is NULL, not false
+			return nil, nil
+		}
 		return false, nil
 	}
 }
@@ -167,32 +226,46 @@ func makeNot(e_tmp E) E {
 	}
 }
 
+// makeOr is SQL OR: true wins, then NULL (unknown), then false.
+// An error on one side loses to true on the other.
 func makeOr(left, right E) E {
-	return func(row map[string]interface{}) (val interface{}, err error) {
-		for _, fn := range []E{left, right} {
-			res, err2 := fn(row)
-			if err != nil || res == nil {
-				err = err2 // error & true should be true.
-			}
-			if res.(bool) == true {
-				return true, nil
-			}
-		}
-		return false, err
-	}
+	return makeLogic(true)(left, right)
 }
 
+// makeAnd is SQL AND: false wins, then NULL (unknown), then true.
+// An error on one side loses to false on the other.
 func makeAnd(left, right E) E {
-	return func(row map[string]interface{}) (val interface{}, err error) {
-		for _, fn := range []E{left, right} {
-			res, err2 := fn(row)
-			if err != nil || res == nil {
-				err = err2 // error && false should be false.
+	return makeLogic(false)(left, right)
+}
+
+// makeLogic builds AND (decider false) or OR (decider true)
+func makeLogic(decider bool) func(left, right E) E {
+	return func(left, right E) E {
+		return func(row map[string]interface{}) (val interface{}, err error) {
+			unknown := false
+			for _, fn := range []E{left, right} {
+				res, err2 := fn(row)
+				if err2 != nil {
+					err = err2
+					continue
+				}
+				if res == nil {
+					unknown = true
+					continue
+				}
+				b, ok := res.(bool)
+				if !ok {
+					err = fmt.Errorf("Couldn't parse value for AND/OR: %v", res)
+					continue
+				}
+				if b == decider {
+					return decider, nil
+				}
 			}
-			if res.(bool) == false {
-				return false, nil
+			if err != nil || unknown {
+				return nil, err
 			}
+			return !decider, nil
 		}
-		return true, err
 	}
 }
@@ -1,10 +1,59 @@
 package expr
 
-import "github.com/snadrus/nodb/internal/base"
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/snadrus/nodb/internal/base"
+)
 
 // E -xpression function
 type E func(map[string]interface{}) (interface{}, error)
 
+// Run is one run of a built query. Expressions are built once, against the
+// tables the query was built on, and find what a run binds in its rows:
+// the tables, args & funcs it reads, the ctx it stops with and, in a
+// correlated subquery, the enclosing query's row.
+type Run struct {
+	Obj   base.Obj
+	Ctx   context.Context
+	Outer map[string]interface{}
+	cache sync.Map // results of uncorrelated subqueries, by expression
+}
+
+// SECRET row-key for the run a row belongs to, like aggDataKey
+const runKey = "nodb_run"
+
+// Row is an empty row of r, to fill with columns
+func (r *Run) Row() map[string]interface{} {
+	return map[string]interface{}{runKey: r}
+}
+
+// RunOf is the run row belongs to
+func RunOf(row map[string]interface{}) (*Run, error) {
+	r, ok := row[runKey].(*Run)
+	if !ok {
+		return nil, errors.New("Impl error: row lacks its run")
+	}
+	return r, nil
+}
+
+type onceResult struct {
+	sync.Once
+	v   interface{}
+	err error
+}
+
+// once runs f the first time key is asked for in r. Later callers get
+// its result.
+func (r *Run) once(key interface{}, f func() (interface{}, error)) (interface{}, error) {
+	v, _ := r.cache.LoadOrStore(key, &onceResult{})
+	res := v.(*onceResult)
+	res.Do(func() { res.v, res.err = f() })
+	return res.v, res.err
+}
+
 // ExpressionBuilder builds expressions with regular functions
 type ExpressionBuilder struct {
 	base.SrcTables
@@ -12,6 +61,7 @@ type ExpressionBuilder struct {
 	Expr          E // Expression storage relating to this builder
 	Obj           map[string]interface{}
 	SubqueryRunner
+	Outer *Outer // set in subqueries, to reach the enclosing query's columns
 }
 
 // DefaultBuilder returns true & OK because it is the default WHERE & HAVING
@@ -27,6 +27,7 @@ func (e *ExpressionBuilder) MakeFunc(fe *sqlparser.FuncExpr) (E, error) {
 	}
 
 	args := []E{}
+	argString = "call .fn"
 	for i, farg := range fe.Exprs {
 		if _, ok := farg.(*sqlparser.StarExpr); ok {
 			return nil, fmt.Errorf("Star in Func not impl, TODO. Like SELECT count(*)")
@@ -42,21 +43,28 @@ func (e *ExpressionBuilder) MakeFunc(fe *sqlparser.FuncExpr) (E, error) {
 		return nil, fmt.Errorf("No arg for func: %s", fe.Name)
 	}
 
-	// Allow their own functions (instead of using funcmap)
-	funcMap := FuncMap
+	// Allow their own functions (instead of using funcmap). Each run
+	// binds its own, so those are found in the run.
 	name := string(fe.Name)
-	fn, ok := FuncMap[name]
-	if !ok {
-		fn, ok = e.Obj[name]
-		if !ok {
-			return nil, fmt.Errorf("Function not found: %s", name)
-		}
-		funcMap = map[string]interface{}{name: fn}
+	_, builtin := FuncMap[name]
+	if _, ok := e.Obj[name]; !builtin && !ok {
+		return nil, fmt.Errorf("Function not found: %s", name)
 	}
-	t, _ := template.New("A").Funcs(funcMap).Parse("{{" + argString + "}}")
+	t, _ := template.New("A").Parse("{{" + argString + "}}")
 
 	return func(row map[string]interface{}) (i interface{}, err error) {
-		templateVars := make(map[string]interface{}, len(args))
+		fn, ok := FuncMap[name]
+		if !builtin {
+			run, err := RunOf(row)
+			if err != nil {
+				return nil, err
+			}
+			if fn, ok = run.Obj[name]; !ok {
+				return nil, fmt.Errorf("Function not found: %s", name)
+			}
+		}
+		templateVars := make(map[string]interface{}, len(args)+1)
+		templateVars["fn"] = fn
 		for i, exp := range args {
 			v, err := exp(row)
 			if err != nil || v == nil {
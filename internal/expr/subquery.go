@@ -3,40 +3,225 @@ package expr
 import (
 	"context"
 	"errors"
-	"sync"
+	"fmt"
 
 	"github.com/snadrus/nodb/internal/base"
 	"github.com/xwb1989/sqlparser"
 )
 
-type SubqueryRunner func(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Context) (chOut chan base.GetChanError, colCh chan []string)
+// SubqueryRunner runs the SELECTs found inside expressions. sel provides it.
+type SubqueryRunner interface {
+	// Compile builds a subquery once, marking the outer fields it reads.
+	Compile(selStmt sqlparser.SelectStatement, src base.Obj, outer *Outer) (Subquery, error)
+	// SemiJoin rewrites an EXISTS subquery tied to outer only by
+	// "inner = outer" equalities into an uncorrelated one listing the inner
+	// sides. ok is false when it can't.
+	SemiJoin(selStmt sqlparser.SelectStatement, src base.Obj, outer *Outer) (keys sqlparser.SelectStatement, outerVals []sqlparser.ValExpr, ok bool)
+}
+
+// Subquery is a built subquery, to start for each run that needs its rows
+type Subquery interface {
+	Types() []base.ColType
+	// Start streams its rows from src's tables until ctx ends. Refs to
+	// outer columns read outerRow.
+	Start(src base.Obj, ctx context.Context, outerRow map[string]interface{}) chan base.GetChanError
+}
+
+// Outer is the enclosing query, as a (correlated) subquery sees it
+type Outer struct {
+	base.SrcTables
+	Parent *Outer
+	used   bool // a ref resolved here or further out
+}
+
+// resolve finds ref in the nearest enclosing query having it, depth
+// queries out. depth is 0 if none has it.
+func (o *Outer) resolve(ref string) (string, int) {
+	depth := 1
+	for at := o; at != nil; at = at.Parent {
+		if v, err := at.ResolveRefAndMarkUsed(ref); err == nil {
+			for u := o; u != at.Parent; u = u.Parent {
+				u.used = true
+			}
+			return v, depth
+		}
+		depth++
+	}
+	return "", 0
+}
+
+// outerCol reads ref from the row of the query depth levels out
+func outerCol(ref string, depth int) E {
+	return func(row map[string]interface{}) (interface{}, error) {
+		for d := depth; d > 0; d-- {
+			run, err := RunOf(row)
+			if err != nil {
+				return nil, err
+			}
+			row = run.Outer
+		}
+		return row[ref], nil
+	}
+}
 
 func (e *ExpressionBuilder) SubqueryToList(t *sqlparser.Subquery) (E, error) {
+	rows, err := e.subqueryRows(t.Select, 0)
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		rs, err := rows(row)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, len(rs))
+		for i, r := range rs {
+			list[i] = r[0]
+		}
+		return list, nil
+	}, nil
+}
+
+// SubqueryToScalar is a subquery used as a value: NULL without rows,
+// an error with more than one.
+func (e *ExpressionBuilder) SubqueryToScalar(t *sqlparser.Subquery) (E, error) {
+	rows, err := e.subqueryRows(t.Select, 2)
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		rs, err := rows(row)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(rs) == 0:
+			return nil, nil
+		case len(rs) > 1:
+			return nil, errors.New("Subquery used as a value returned more than 1 row")
+		case len(rs[0]) != 1:
+			return nil, fmt.Errorf("Subquery used as a value returned %d columns, not 1", len(rs[0]))
+		}
+		return rs[0][0], nil
+	}, nil
+}
+
+// makeExists is EXISTS (subquery). NOT EXISTS wraps it in makeNot.
+func (e *ExpressionBuilder) makeExists(t *sqlparser.ExistsExpr) (E, error) {
 	if e.SubqueryRunner == nil {
 		return nil, errors.New("Impl error: ExpressionBuilder lacks SubqueryRunner")
 	}
-	done := sync.Mutex{}
-	var mutexedListResult []interface{}
-	var mutexedErr error
-	done.Lock()
-	go func() {
-		defer done.Unlock()
-		ctx := context.Background()
-		chRows, colCh := e.SubqueryRunner(t.Select, e.Obj, ctx)
-		go func() {
-			_ = <-colCh
-		}()
-		for row := range chRows {
+	outer := &Outer{SrcTables: e.SrcTables, Parent: e.Outer}
+	if keys, outerVals, ok := e.SubqueryRunner.SemiJoin(t.Subquery.Select, e.Obj, outer); ok {
+		return e.makeSemiJoin(keys, outerVals)
+	}
+	rows, err := e.subqueryRows(t.Subquery.Select, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		rs, err := rows(row)
+		if err != nil {
+			return nil, err
+		}
+		return len(rs) > 0, nil
+	}, nil
+}
+
+// makeSemiJoin does EXISTS by looking the outer values up among the keys,
+// which are listed once rather than per outer row.
+func (e *ExpressionBuilder) makeSemiJoin(keys sqlparser.SelectStatement, outerVals []sqlparser.ValExpr) (E, error) {
+	vals, err := e.MakeSlice(outerVals)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := e.subqueryRows(keys, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := new(int) // this EXISTS, in a run's cache
+	return func(row map[string]interface{}) (interface{}, error) {
+		run, err := RunOf(row)
+		if err != nil {
+			return nil, err
+		}
+		set, err := run.once(key, func() (interface{}, error) {
+			rs, err := rows(row)
+			if err != nil {
+				return nil, err
+			}
+			set := map[string]bool{}
+			for _, r := range rs {
+				k, ok, err := base.HashKey(r)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					set[k] = true
+				}
+			}
+			return set, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		v, err := vals(row)
+		if err != nil {
+			return nil, err
+		}
+		k, ok, err := base.HashKey(v.([]interface{}))
+		if err != nil || !ok { // NULL matches nothing
+			return false, err
+		}
+		return set.(map[string]bool)[k], nil
+	}, nil
+}
+
+// subqueryRows builds stmt to run for an outer row. Uncorrelated subqueries
+// run just once per run of ours, on first use. max > 0 stops after that
+// many rows.
+func (e *ExpressionBuilder) subqueryRows(stmt sqlparser.SelectStatement, max int) (func(map[string]interface{}) ([][]interface{}, error), error) {
+	if e.SubqueryRunner == nil {
+		return nil, errors.New("Impl error: ExpressionBuilder lacks SubqueryRunner")
+	}
+	probe := &Outer{SrcTables: e.SrcTables, Parent: e.Outer}
+	q, err := e.SubqueryRunner.Compile(stmt, e.Obj, probe)
+	if err != nil {
+		return nil, err
+	}
+	start := func(run *Run, outerRow map[string]interface{}) ([][]interface{}, error) {
+		ctx, cancel := context.WithCancel(run.Ctx)
+		defer cancel() // stops it if we stop reading early
+		res := [][]interface{}{}
+		for row := range q.Start(run.Obj, ctx, outerRow) {
 			if row.Err != nil {
-				mutexedErr = row.Err
-				return
+				return nil, row.Err
 			}
-			mutexedListResult = append(mutexedListResult, row.Item[0])
+			res = append(res, row.Item)
+			if len(res) == max {
+				return res, nil
+			}
+		}
+		return res, ctx.Err() // the rows may be cut short by the query ending
+	}
+	if !probe.used {
+		return func(row map[string]interface{}) ([][]interface{}, error) {
+			run, err := RunOf(row)
+			if err != nil {
+				return nil, err
+			}
+			res, err := run.once(q, func() (interface{}, error) { return start(run, nil) })
+			if err != nil {
+				return nil, err
+			}
+			return res.([][]interface{}), nil
+		}, nil
+	}
+	return func(row map[string]interface{}) ([][]interface{}, error) {
+		run, err := RunOf(row)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	return func(map[string]interface{}) (interface{}, error) {
-		done.Lock() // This ensures the writing has stopped
-		defer done.Unlock()
-		return mutexedListResult, mutexedErr
+		return start(run, row)
 	}, nil
 }
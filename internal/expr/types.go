@@ -0,0 +1,164 @@
+package expr
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/xwb1989/sqlparser"
+)
+
+var (
+	typeInt    = reflect.TypeOf(0)
+	typeFloat  = reflect.TypeOf(0.0)
+	typeString = reflect.TypeOf("")
+	typeBool   = reflect.TypeOf(true)
+	typeTime   = reflect.TypeOf(time.Time{})
+)
+
+// TypeOf works out what tree's values will be without running it.
+// Build tree first, so its column refs resolve.
+func (e *ExpressionBuilder) TypeOf(tree sqlparser.Expr) base.ColType {
+	switch t := tree.(type) {
+	case sqlparser.StrVal:
+		return base.ColType{Type: typeString, NullKnown: true}
+	case sqlparser.NumVal: // as MakeVal does it
+		f64, _ := strconv.ParseFloat(string(t), 64)
+		iSys, _ := strconv.Atoi(string(t))
+		if float64(iSys) == f64 {
+			return base.ColType{Type: typeInt, NullKnown: true}
+		}
+		return base.ColType{Type: typeFloat, NullKnown: true}
+	case sqlparser.ValArg:
+		v := e.Obj[string(t)]
+		return base.ColType{Type: reflect.TypeOf(v), Nullable: v == nil, NullKnown: true}
+	case *sqlparser.NullVal:
+		return base.ColType{Nullable: true, NullKnown: true}
+	case *sqlparser.ColName:
+		return e.colType(t)
+	case *sqlparser.BinaryExpr:
+		return binaryType(t.Operator, e.TypeOf(t.Left), e.TypeOf(t.Right))
+	case *sqlparser.FuncExpr:
+		return e.funcType(t)
+	case *sqlparser.CaseExpr:
+		return e.caseType(t)
+	case *sqlparser.Subquery: // a scalar: NULL without rows
+		if e.SubqueryRunner == nil {
+			return base.ColType{}
+		}
+		q, err := e.SubqueryRunner.Compile(t.Select, e.Obj, &Outer{SrcTables: e.SrcTables, Parent: e.Outer})
+		if err != nil || len(q.Types()) != 1 {
+			return base.ColType{}
+		}
+		return base.ColType{Type: q.Types()[0].Type, Nullable: true, NullKnown: true}
+	case sqlparser.BoolExpr: // NULL when unknown
+		return base.ColType{Type: typeBool}
+	}
+	return base.ColType{}
+}
+
+func (e *ExpressionBuilder) colType(c *sqlparser.ColName) base.ColType {
+	n := string(c.Name)
+	if len(c.Qualifier) > 0 {
+		n = string(c.Qualifier) + "." + n
+	}
+	ts := e.SrcTables
+	ref, err := ts.ResolveRefAndMarkUsed(n)
+	if err != nil {
+		o := e.Outer
+		depth := 0
+		if ref, depth = o.resolve(n); depth == 0 {
+			return base.ColType{}
+		}
+		for ; depth > 1; depth-- {
+			o = o.Parent
+		}
+		ts = o.SrcTables
+	}
+	pcs := strings.SplitN(ref, ".", 2)
+	if t := ts[pcs[0]]; t != nil && len(pcs) == 2 {
+		return t.FieldType(pcs[1])
+	}
+	return base.ColType{}
+}
+
+// binaryType follows govaluate: + joins strings, other math is float64
+func binaryType(op byte, l, r base.ColType) base.ColType {
+	ct := base.ColType{Nullable: l.Nullable || r.Nullable, NullKnown: l.NullKnown && r.NullKnown}
+	switch {
+	case l.Type == nil || r.Type == nil:
+	case op == sqlparser.AST_PLUS && (l.Type == typeString || r.Type == typeString):
+		ct.Type = typeString
+	case isNumeric(l.Type) && isNumeric(r.Type):
+		ct.Type = typeFloat
+	}
+	return ct
+}
+
+// isNumeric: numbers & times, which doBinOp makes numbers
+func isNumeric(t reflect.Type) bool {
+	k := t.Kind()
+	return k >= reflect.Int && k <= reflect.Float64 || t == typeTime
+}
+
+func (e *ExpressionBuilder) funcType(fe *sqlparser.FuncExpr) base.ColType {
+	name := string(fe.Name)
+	switch name {
+	case "count":
+		return base.ColType{Type: typeInt, NullKnown: true}
+	case "avg", "min", "max", "sum":
+		return base.ColType{Type: typeFloat, NullKnown: true}
+	}
+	fn, ok := FuncMap[name]
+	if !ok {
+		fn = e.Obj[name]
+	}
+	ct := base.ColType{NullKnown: true}
+	for _, farg := range fe.Exprs { // NULL in, NULL out
+		if nse, ok := farg.(*sqlparser.NonStarExpr); ok {
+			arg := e.TypeOf(nse.Expr)
+			ct.Nullable = ct.Nullable || arg.Nullable
+			ct.NullKnown = ct.NullKnown && arg.NullKnown
+		}
+	}
+	if fv := reflect.ValueOf(fn); fv.Kind() == reflect.Func && fv.Type().NumOut() > 0 {
+		switch fv.Type().Out(0).Kind() { // as MakeFunc converts them
+		case reflect.String:
+			ct.Type = typeString
+		case reflect.Int:
+			ct.Type = typeInt
+		case reflect.Float64:
+			ct.Type = typeFloat
+		}
+	}
+	return ct
+}
+
+// caseType is the type all results share, if they do
+func (e *ExpressionBuilder) caseType(c *sqlparser.CaseExpr) base.ColType {
+	results := []sqlparser.ValExpr{}
+	for _, w := range c.Whens {
+		results = append(results, w.Val)
+	}
+	ct := base.ColType{Nullable: c.Else == nil, NullKnown: true}
+	if c.Else != nil {
+		results = append(results, c.Else)
+	}
+	first := true
+	for _, r := range results {
+		rt := e.TypeOf(r)
+		ct.Nullable = ct.Nullable || rt.Nullable
+		ct.NullKnown = ct.NullKnown && rt.NullKnown
+		if _, isNull := r.(*sqlparser.NullVal); isNull {
+			continue
+		}
+		if first {
+			ct.Type, first = rt.Type, false
+		} else if ct.Type != rt.Type {
+			ct.Type = nil
+		}
+	}
+	return ct
+}
@@ -23,7 +23,23 @@ func (e *ExpressionBuilder) MakeVal(tree sqlparser.ValExpr) (E, error) {
 		}
 		return retval(f64, nil), nil
 	case sqlparser.ValArg: // "?" solves SQL injection (~ok) & query plan reuse (useless).
-		return nil, fmt.Errorf("ValArg not impl, TODO")
+		// Bound values ride in Obj as ":v1" or ":name", never a table or func name.
+		// Each run binds its own, so they're read from the run.
+		name := string(tree.(sqlparser.ValArg))
+		if _, ok := e.Obj[name]; !ok {
+			return nil, fmt.Errorf("No value bound for %s", name)
+		}
+		return func(row map[string]interface{}) (interface{}, error) {
+			run, err := RunOf(row)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := run.Obj[name]
+			if !ok {
+				return nil, fmt.Errorf("No value bound for %s", name)
+			}
+			return v, nil
+		}, nil
 	case *sqlparser.NullVal:
 		return retval(nil, nil), nil
 	case *sqlparser.ColName:
@@ -34,6 +50,9 @@ func (e *ExpressionBuilder) MakeVal(tree sqlparser.ValExpr) (E, error) {
 		}
 		v, err := e.SrcTables.ResolveRefAndMarkUsed(n)
 		if err != nil {
+			if ref, depth := e.Outer.resolve(n); depth > 0 { // correlated subquery
+				return outerCol(ref, depth), nil
+			}
 			return nil, err
 		}
 		return e.retcol(v), nil
@@ -43,8 +62,7 @@ func (e *ExpressionBuilder) MakeVal(tree sqlparser.ValExpr) (E, error) {
 		ave := ([]sqlparser.ValExpr)(ve)
 		return e.MakeSlice(ave)
 	case *sqlparser.Subquery:
-		return e.SubqueryToList(tree.(*sqlparser.Subquery))
-		return nil, fmt.Errorf("subquery not impl, TODO")
+		return e.SubqueryToScalar(tree.(*sqlparser.Subquery))
 	case sqlparser.ListArg: // RARE: A named-list argument
 		return nil, fmt.Errorf("ListArg not impl, TODO")
 	case *sqlparser.BinaryExpr:
@@ -55,14 +73,67 @@ func (e *ExpressionBuilder) MakeVal(tree sqlparser.ValExpr) (E, error) {
 		// EZ: reuse template code. Solves basic types.
 		return e.MakeFunc(tree.(*sqlparser.FuncExpr))
 	case *sqlparser.CaseExpr:
-		_ = tree.(*sqlparser.CaseExpr)
 		// case EXPR ((WHEN boolVal) THEN (whenexpr))+ ELSE elseexpr
-		return nil, fmt.Errorf("Case not impl, TODO")
+		return e.makeCase(tree.(*sqlparser.CaseExpr))
 	}
 
 	return nil, fmt.Errorf("wacky value")
 }
 
+// makeCase does CASE x WHEN v THEN ... (x equals v) and CASE WHEN cond THEN ...
+// The first match wins. Without a match or ELSE it is NULL.
+func (e *ExpressionBuilder) makeCase(c *sqlparser.CaseExpr) (E, error) {
+	var subject E
+	var err error
+	if c.Expr != nil {
+		if subject, err = e.MakeVal(c.Expr); err != nil {
+			return nil, err
+		}
+	}
+	conds := make([]E, len(c.Whens))
+	vals := make([]E, len(c.Whens))
+	for i, w := range c.Whens {
+		if conds[i], err = e.ExprToE(w.Cond); err != nil {
+			return nil, err
+		}
+		if vals[i], err = e.MakeVal(w.Val); err != nil {
+			return nil, err
+		}
+	}
+	elseE := retval(nil, nil)
+	if c.Else != nil {
+		if elseE, err = e.MakeVal(c.Else); err != nil {
+			return nil, err
+		}
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		var s interface{}
+		if subject != nil {
+			var err error
+			if s, err = subject(row); err != nil {
+				return nil, err
+			}
+		}
+		for i, cond := range conds {
+			v, err := cond(row)
+			if err != nil {
+				return nil, err
+			}
+			if subject == nil {
+				if b, ok := v.(bool); !ok || !b {
+					continue
+				}
+			} else if s == nil || v == nil {
+				continue // NULL matches nothing
+			} else if m, err := eq.Evaluate(map[string]interface{}{"l": s, "r": v}); err != nil || m != true {
+				continue
+			}
+			return vals[i](row)
+		}
+		return elseE(row)
+	}, nil
+}
+
 func (e *ExpressionBuilder) MakeSlice(t []sqlparser.ValExpr) (E, error) {
 	res := []E{}
 	// TODO determine if they're static values and pass-it-on
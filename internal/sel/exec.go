@@ -3,15 +3,17 @@ package sel
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/kr/pretty"
 	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/expr"
 )
 
 // a fake FROM table to get things going
-func getInitialRow() (chain chan row) {
+func getInitialRow(run *expr.Run) (chain chan row) {
 	chain = make(chan row, 1)
-	chain <- make(row) // Start the nested for loops
+	chain <- run.Row() // Start the nested for loops
 	close(chain)
 	return chain
 }
@@ -27,42 +29,60 @@ func rowDup(m row) row {
 	}
 	return myMap
 }
+
+// stopped is true once the query is cancelled. It never waits.
+func stopped(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 func doNest(je *joinElement, ctx context.Context, cancelFunc CancelWithError) chainType {
 	ch := make(chainType, 5)
 	je.resultChan = ch
 	go func() {
 		defer close(ch)
+		defer closeTable(je)
 		var prev chan row
 		if je.from == nil {
-			prev = getInitialRow()
+			prev = getInitialRow(je.run)
 		} else {
 			prev = je.from.resultChan
 			je.table.Table.SetConfig(true)
 		}
-		if je.condition == nil {
-			je.condition = goodCondition
-		}
 
 		tname := je.table.Name
 		joined := false
 		base.Debug("DONEST for ", pretty.Sprint(tname))
-		// TODO PERF apply flat conditions
 		for m := range prev {
 			// Handle Full Join
 			joined = false
 			for je.table.Table.NextRow() { // for every row in my table
-				myMap := rowDup(m)
-
-				err := je.table.Table.GetFields(je.table.UsedFields, tname+".", myMap)
+				if stopped(ctx) {
+					return
+				}
+				tr, keep, err := je.tableRow()
 				if err != nil {
 					cancelFunc(err)
+					return
+				}
+				if !keep { // pushed-down WHERE
+					continue
+				}
+				myMap := rowDup(m)
+				for k, v := range tr {
+					myMap[k] = v
 				}
 
 				r, err := je.condition(myMap)
 				if err != nil {
 					cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+					return
 				}
-				if r.(bool) {
+				if b, _ := r.(bool); b { // NULL is not true
 					base.Debug("JOIN Condition true for ", myMap)
 					select {
 					case ch <- myMap:
@@ -73,19 +93,351 @@ func doNest(je *joinElement, ctx context.Context, cancelFunc CancelWithError) ch
 				}
 			}
 			if !joined && je.fullOther { // Left join
-				myMap := rowDup(m)
-				base.Debug("map before nulling:", myMap, "used fields:", je.table.UsedFields)
-				for name := range je.table.UsedFields {
-					myMap[tname+"."+name] = nil
+				select {
+				case ch <- leftJoinRow(je, m):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// closeTable lets je's table release what it holds, once its reader is done
+func closeTable(je *joinElement) {
+	if c, ok := je.table.Table.(base.CanClose); ok {
+		c.Close()
+	}
+}
+
+// tableRow reads the current row of je's table. keep is false when the
+// WHERE parts pushed down to this table reject it.
+func (je *joinElement) tableRow() (r row, keep bool, err error) {
+	r = je.run.Row()
+	if err = je.table.Table.GetFields(je.table.UsedFields, je.table.Name+".", r); err != nil {
+		return nil, false, err
+	}
+	if je.filter == nil {
+		return r, true, nil
+	}
+	res, err := je.filter(r)
+	if err != nil {
+		return nil, false, err
+	}
+	keep, _ = res.(bool) // NULL is not true
+	return r, keep, nil
+}
+
+// leftJoinRow is the left row with NULLs for every field of je's table
+func leftJoinRow(je *joinElement, m row) row {
+	myMap := rowDup(m)
+	base.Debug("map before nulling:", myMap, "used fields:", je.table.UsedFields)
+	for name := range je.table.UsedFields {
+		myMap[je.table.Name+"."+name] = nil
+	}
+	base.Debug("Left Join row detected for", myMap)
+	return myMap
+}
+
+// doHash reads its table once into a map keyed on the ON equalities, then
+// probes it per left row. The whole ON condition is still checked per match.
+func doHash(je *joinElement, ctx context.Context, cancelFunc CancelWithError) chainType {
+	ch := make(chainType, 5)
+	je.resultChan = ch
+	go func() {
+		defer close(ch)
+		defer closeTable(je)
+
+		tname := je.table.Name
+		base.Debug("DOHASH for ", pretty.Sprint(tname))
+		buckets := map[string][]row{}
+		for je.table.Table.NextRow() {
+			if stopped(ctx) {
+				return
+			}
+			r, keep, err := je.tableRow()
+			if err != nil {
+				cancelFunc(err)
+				return
+			}
+			if !keep {
+				continue
+			}
+			key, ok, err := je.hashKey(r, false)
+			if err != nil {
+				cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+				return
+			}
+			if ok { // NULL keys never match
+				buckets[key] = append(buckets[key], r)
+			}
+		}
+
+		for m := range je.from.resultChan {
+			if stopped(ctx) {
+				return
+			}
+			joined := false
+			key, ok, err := je.hashKey(m, true)
+			if err != nil {
+				cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+				return
+			}
+			if ok {
+				for _, r := range buckets[key] {
+					myMap := rowDup(m)
+					for k, v := range r {
+						myMap[k] = v
+					}
+					res, err := je.condition(myMap)
+					if err != nil {
+						cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+						return
+					}
+					if b, _ := res.(bool); b {
+						select {
+						case ch <- myMap:
+						case <-ctx.Done():
+							return
+						}
+						joined = true
+					}
+				}
+			}
+			if !joined && je.fullOther {
+				select {
+				case ch <- leftJoinRow(je, m):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// hashKey renders the equality columns of r so that values the ON condition
+// calls equal share a key. ok is false when any of them is NULL.
+func (je *joinElement) hashKey(r row, leftSide bool) (key string, ok bool, err error) {
+	vals := make([]interface{}, len(je.equiKeys))
+	for i, k := range je.equiKeys {
+		e := k.right
+		if leftSide {
+			e = k.left
+		}
+		if vals[i], err = e(r); err != nil {
+			return "", false, err
+		}
+	}
+	return base.HashKey(vals)
+}
+
+// doMerge joins two inputs sorted on the same ON equality in a single pass
+// over each. The table is never re-read, so channel tables need no caching.
+func doMerge(je *joinElement, ctx context.Context, cancelFunc CancelWithError) chainType {
+	ch := make(chainType, 5)
+	je.resultChan = ch
+	go func() {
+		defer close(ch)
+		defer closeTable(je)
+		base.Debug("DOMERGE for ", pretty.Sprint(je.table.Name))
+		key := je.equiKeys[je.mergeKey]
+		cur := &mergeCursor{je: je, key: key.right, desc: je.mergeDesc}
+		if err := cur.advance(); err != nil {
+			cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+			return
+		}
+		for m := range je.from.resultChan {
+			if stopped(ctx) {
+				return
+			}
+			joined := false
+			v, err := key.left(m)
+			if err != nil {
+				cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+				return
+			}
+			if k, ok := base.NormalizeKey(v); ok {
+				run, err := cur.runFor(k)
+				if err != nil {
+					cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+					return
+				}
+				for _, r := range run {
+					myMap := rowDup(m)
+					for k, v := range r {
+						myMap[k] = v
+					}
+					res, err := je.condition(myMap)
+					if err != nil {
+						cancelFunc(fmt.Errorf("JOIN Error, %s", err.Error()))
+						return
+					}
+					if b, _ := res.(bool); b {
+						select {
+						case ch <- myMap:
+						case <-ctx.Done():
+							return
+						}
+						joined = true
+					}
 				}
-				base.Debug("Left Join row detected for", myMap)
+			}
+			if !joined && je.fullOther {
 				select {
-				case ch <- myMap:
+				case ch <- leftJoinRow(je, m):
 				case <-ctx.Done():
 					return
 				}
 			}
 		}
+		cur.drain(ctx)
 	}()
 	return ch
 }
+
+// mergeCursor walks a sorted table once, handing out runs of equal keys.
+type mergeCursor struct {
+	je     *joinElement
+	key    expr.E
+	desc   bool
+	done   bool
+	cur    row
+	curKey interface{}
+	run    []row
+	runKey interface{}
+}
+
+func (c *mergeCursor) compare(a, b interface{}) (int, error) {
+	res, err := compareKeys(a, b)
+	if c.desc {
+		res = -res
+	}
+	return res, err
+}
+
+// advance loads the next table row with a non-NULL key, checking the order.
+func (c *mergeCursor) advance() error {
+	for !c.done && c.je.table.Table.NextRow() {
+		r, keep, err := c.je.tableRow()
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		v, err := c.key(r)
+		if err != nil {
+			return err
+		}
+		k, ok := base.NormalizeKey(v)
+		if !ok { // NULLs never join
+			continue
+		}
+		if c.cur != nil {
+			if cmp, err := c.compare(c.curKey, k); err != nil {
+				return err
+			} else if cmp > 0 {
+				return fmt.Errorf("table %s is not sorted as declared", c.je.table.Name)
+			}
+		}
+		c.cur, c.curKey = r, k
+		return nil
+	}
+	c.done = true
+	return nil
+}
+
+// drain reads out a table the left side no longer needs, so a channel's
+// sender isn't left blocked
+func (c *mergeCursor) drain(ctx context.Context) {
+	for !c.done && !stopped(ctx) && c.je.table.Table.NextRow() {
+	}
+	c.done = true
+}
+
+// runFor gives the table rows keyed k. Keys must be asked for in sort order.
+func (c *mergeCursor) runFor(k interface{}) ([]row, error) {
+	if c.runKey != nil {
+		cmp, err := c.compare(c.runKey, k)
+		if err != nil {
+			return nil, err
+		}
+		if cmp == 0 {
+			return c.run, nil
+		}
+		if cmp > 0 {
+			return nil, fmt.Errorf("rows joining %s are not sorted as declared", c.je.table.Name)
+		}
+	}
+	c.run, c.runKey = nil, k
+	for !c.done {
+		cmp, err := c.compare(c.curKey, k)
+		if err != nil {
+			return nil, err
+		}
+		if cmp > 0 {
+			break
+		}
+		if cmp == 0 {
+			c.run = append(c.run, c.cur)
+		}
+		if err := c.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return c.run, nil
+}
+
+// compareKeys orders two normalizeKey results. Different kinds never
+// match, as with the other strategies, so they just sort by kind.
+func compareKeys(a, b interface{}) (int, error) {
+	if ka, kb := keyKind(a), keyKind(b); ka != kb {
+		return ka - kb, nil
+	}
+	switch av := a.(type) {
+	case float64:
+		bv := b.(float64)
+		switch {
+		case av < bv:
+			return -1, nil
+		case av > bv:
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strings.Compare(av, b.(string)), nil
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0, nil
+		case bv:
+			return -1, nil
+		}
+		return 1, nil
+	}
+	ka, _, err := base.HashKey([]interface{}{a}) // equal just when hashJoin says so
+	if err != nil {
+		return 0, err
+	}
+	kb, _, err := base.HashKey([]interface{}{b})
+	if err != nil {
+		return 0, err
+	}
+	return strings.Compare(ka, kb), nil
+}
+
+// keyKind ranks the kinds of normalizeKey results for compareKeys
+func keyKind(v interface{}) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	}
+	return 3
+}
@@ -0,0 +1,176 @@
+package sel
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Explanation tells how a SELECT would run. Empty strings are absent stages.
+type Explanation struct {
+	Tables   []ExplainTable // in join order
+	Where    string         // checked on joined rows
+	GroupBy  string
+	Having   string
+	OrderBy  string
+	Distinct bool
+	Limit    string
+}
+
+// ExplainTable is one joinElement
+type ExplainTable struct {
+	Name       string
+	Join       string // "" for the first table, else "join" or "left join"
+	Strategy   string // "scan", "nested loop", "hash" or "merge"
+	On         string
+	Filter     string // WHERE parts applied while reading the table
+	UsedFields []string
+}
+
+var strategyNames = map[joinStrategy]string{
+	nestedLoop: "nested loop",
+	hashJoin:   "hash",
+	mergeJoin:  "merge",
+}
+
+// Explain plans a SELECT without running it.
+func Explain(stmt sqlparser.SelectStatement, src base.Obj) (*Explanation, error) {
+	tree, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return nil, errors.New("EXPLAIN of UNION not supported")
+	}
+	p, _, err := buildPlan(tree, src, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Explanation{Distinct: p.distinct}
+	for _, je := range p.joins {
+		t := ExplainTable{Name: je.table.Name, Strategy: "scan"}
+		if je.from != nil {
+			t.Strategy = strategyNames[je.strategy]
+			t.Join = "join"
+			if je.fullOther {
+				t.Join = "left join"
+			}
+		}
+		if je.on != nil {
+			t.On = sqlparser.String(je.on)
+		}
+		if je.filterExpr != nil {
+			t.Filter = sqlparser.String(je.filterExpr)
+		}
+		for f := range je.table.UsedFields {
+			t.UsedFields = append(t.UsedFields, f)
+		}
+		sort.Strings(t.UsedFields)
+		e.Tables = append(e.Tables, t)
+	}
+	if p.whereExpr != nil {
+		e.Where = sqlparser.String(p.whereExpr)
+	}
+	if tree.GroupBy != nil {
+		e.GroupBy = strings.TrimPrefix(sqlparser.String(tree.GroupBy), " group by ")
+	}
+	if tree.Having != nil {
+		e.Having = sqlparser.String(tree.Having.Expr)
+	}
+	if tree.OrderBy != nil {
+		e.OrderBy = strings.TrimPrefix(sqlparser.String(tree.OrderBy), " order by ")
+	}
+	if tree.Limit != nil {
+		e.Limit = strings.TrimPrefix(sqlparser.String(tree.Limit), " limit ")
+	}
+	return e, nil
+}
+
+var explainColumns = []string{"Step", "Table", "Detail"}
+
+// rows lays out an Explanation as the result of an EXPLAIN statement
+func (e *Explanation) rows() [][]interface{} {
+	res := [][]interface{}{}
+	for _, t := range e.Tables {
+		step := t.Strategy
+		if t.Join != "" {
+			step = t.Join + " (" + t.Strategy + ")"
+		}
+		detail := []string{}
+		if t.On != "" {
+			detail = append(detail, "on "+t.On)
+		}
+		if t.Filter != "" {
+			detail = append(detail, "filter "+t.Filter)
+		}
+		detail = append(detail, "fields "+strings.Join(t.UsedFields, ", "))
+		res = append(res, []interface{}{step, t.Name, strings.Join(detail, "; ")})
+	}
+	stage := func(step, detail string) {
+		res = append(res, []interface{}{step, "", detail})
+	}
+	if e.Where != "" {
+		stage("where", e.Where)
+	}
+	if e.GroupBy != "" {
+		stage("group by", e.GroupBy)
+	}
+	if e.Having != "" {
+		stage("having", e.Having)
+	}
+	if e.OrderBy != "" {
+		stage("order by", e.OrderBy)
+	}
+	if e.Distinct {
+		stage("distinct", "")
+	}
+	if e.Limit != "" {
+		stage("limit", e.Limit)
+	}
+	return res
+}
+
+// explainChan feeds EXPLAIN output like GetChan feeds query results
+func explainChan(tree sqlparser.SelectStatement, src base.Obj) (chan base.GetChanError, chan []string) {
+	ch := make(chan base.GetChanError, 20)
+	chColNames := make(chan []string, 1)
+	go func() {
+		defer close(ch)
+		e, err := Explain(tree, src)
+		if err != nil {
+			chColNames <- []string{}
+			ch <- base.GetChanError{Err: err}
+			return
+		}
+		chColNames <- explainColumns
+		for _, r := range e.rows() {
+			ch <- base.GetChanError{Item: r}
+		}
+	}()
+	return ch, chColNames
+}
+
+// DoExplain is Do for EXPLAIN SELECT
+func DoExplain(tree sqlparser.SelectStatement, result interface{}, src base.Obj) error {
+	ch, chColNames := explainChan(tree, src)
+	return collect(ch, chColNames, result)
+}
+
+// DoAryExplain is DoAry for EXPLAIN SELECT
+func DoAryExplain(tree sqlparser.SelectStatement, src base.Obj) (driver.Rows, error) {
+	ch, chColNames := explainChan(tree, src)
+	text := base.ColType{Type: reflect.TypeOf(""), NullKnown: true}
+	chColTypes := make(chan []base.ColType, 1)
+	chColTypes <- []base.ColType{text, text, text}
+	return &Rows{
+		colNamesCh: chColNames,
+		colTypesCh: chColTypes,
+		ch:         ch,
+		ctx:        context.Background(),
+		cancel:     func() {},
+	}, nil
+}
@@ -1,13 +1,12 @@
 package sel
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 
-	"github.com/fatih/structs"
 	"github.com/kr/pretty"
 	"github.com/snadrus/nodb/internal/base"
 	"github.com/snadrus/nodb/internal/expr"
@@ -23,16 +22,35 @@ type from struct {
 type joinElement struct {
 	from       *joinElement // left side, or NULL if that would be us.
 	condition  expr.E
+	on         sqlparser.BoolExpr // source of condition, for EXPLAIN
+	filter     expr.E             // WHERE parts on this table alone, nil if none
+	filterExpr sqlparser.BoolExpr // source of filter
+	equiKeys   []equiKey          // ON terms of the form left.x = table.y
+	strategy   joinStrategy
+	mergeKey   int  // equiKeys index both sides are sorted on, for mergeJoin
+	mergeDesc  bool // ... in descending order
 	table      *base.SrcTable
 	fullOther  bool // Do you want all their rows?
+	// open gives the table as a run has it. run is set in a run's copy.
+	open       func(run *expr.Run) (base.RowProvider, error)
+	run        *expr.Run
 	resultChan chan row
 }
 
+// equiKey is one "left = right" equality from an ON clause.
+// left reads from the rows coming in, right from this element's table.
+type equiKey struct {
+	left, right       expr.E
+	leftRef, rightRef string // resolved "table.Field" names
+}
+
 func (f *from) MakeJoinTree(je *sqlparser.JoinTableExpr) (*joinElement, error) {
 	// Recurse, collecting names, conditions
-	if je.Join == sqlparser.AST_RIGHT_JOIN { // Swap
-		je.LeftExpr, je.RightExpr = je.RightExpr, je.LeftExpr
-		je.Join = sqlparser.AST_LEFT_JOIN
+	if je.Join == sqlparser.AST_RIGHT_JOIN { // Swap, in a copy: the tree may be a Prepared one
+		swapped := *je
+		swapped.LeftExpr, swapped.RightExpr = je.RightExpr, je.LeftExpr
+		swapped.Join = sqlparser.AST_LEFT_JOIN
+		je = &swapped
 	}
 	left, err := f.MakeJoinElement(je.LeftExpr) // ok for joinElement
 	if err != nil {
@@ -52,6 +70,13 @@ func (f *from) MakeJoinTree(je *sqlparser.JoinTableExpr) (*joinElement, error) {
 	}
 	right.from = left
 	right.condition = cnd
+	right.on = je.On
+	if je.On != nil {
+		right.equiKeys, err = f.findEquiKeys(je.On, right.table.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
 	switch je.Join {
 	case sqlparser.AST_NATURAL_JOIN:
 		return nil, errors.New("Natural Join not supported")
@@ -61,11 +86,74 @@ func (f *from) MakeJoinTree(je *sqlparser.JoinTableExpr) (*joinElement, error) {
 		return nil, errors.New("Straight Join not supported.")
 	case sqlparser.AST_LEFT_JOIN:
 		right.fullOther = true
+		right.table.Nullable = true
 	case sqlparser.AST_JOIN:
 	}
 	return right, nil
 }
 
+// findEquiKeys collects the AND-ed equalities between a column of tableName
+// and a column of an earlier table. Anything else stays in the ON condition.
+func (f *from) findEquiKeys(on sqlparser.BoolExpr, tableName string) ([]equiKey, error) {
+	keys := []equiKey{}
+	var walk func(b sqlparser.BoolExpr) error
+	walk = func(b sqlparser.BoolExpr) error {
+		switch t := b.(type) {
+		case *sqlparser.ParenBoolExpr:
+			return walk(t.Expr)
+		case *sqlparser.AndExpr:
+			if err := walk(t.Left); err != nil {
+				return err
+			}
+			return walk(t.Right)
+		case *sqlparser.ComparisonExpr:
+			if t.Operator != sqlparser.AST_EQ {
+				return nil
+			}
+			lCol, lok := t.Left.(*sqlparser.ColName)
+			rCol, rok := t.Right.(*sqlparser.ColName)
+			if !lok || !rok {
+				return nil
+			}
+			lRef, err := f.refOf(lCol)
+			if err != nil {
+				return nil // an outer query's column
+			}
+			rRef, err := f.refOf(rCol)
+			if err != nil {
+				return nil
+			}
+			lTable, rTable := tableOfRef(lRef), tableOfRef(rRef)
+			if lTable == tableName && rTable != tableName {
+				lCol, rCol = rCol, lCol
+				lRef, rRef = rRef, lRef
+			} else if !(rTable == tableName && lTable != tableName) {
+				return nil
+			}
+			leftE, err := f.exprBuilder.MakeVal(lCol)
+			if err != nil {
+				return err
+			}
+			rightE, err := f.exprBuilder.MakeVal(rCol)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, equiKey{left: leftE, right: rightE, leftRef: lRef, rightRef: rRef})
+		}
+		return nil
+	}
+	return keys, walk(on)
+}
+
+// refOf resolves a column reference to its "table.Field" name.
+func (f *from) refOf(c *sqlparser.ColName) (string, error) {
+	return f.src.ResolveRefAndMarkUsed(colRefName(c))
+}
+
+func tableOfRef(ref string) string {
+	return strings.SplitN(ref, ".", 2)[0]
+}
+
 /*
 Normal 3-way join:  a join b left join c
    T
@@ -85,105 +173,102 @@ func (f *from) MakeJoinElement(table sqlparser.TableExpr) (*joinElement, error)
 		switch aliasedTable.Expr.(type) {
 		case *sqlparser.TableName:
 			tn := aliasedTable.Expr.(*sqlparser.TableName) // already lowercased
-			name := string(tn.Name)
+			tableName := string(tn.Name)
 			// TODO LATER consume tn.Qualifier
-			tdata, ok := f.obj[name] // Get table from object
-
+			tdata, ok := f.obj.Table(tableName) // Get table from object
 			if !ok {
-				for ttmpName := range f.obj { /// work around auto-lowercase of tablename
-					if strings.ToLower(ttmpName) == name {
-						ok = true
-						tdata = f.obj[ttmpName]
-					}
-				}
-				if !ok {
-					return nil, fmt.Errorf("missing table %s", tn.Name)
-				}
+				return nil, fmt.Errorf("missing table %s", tn.Name)
 			}
+			name := tableName
 			if len(aliasedTable.As) != 0 {
 				name = string(aliasedTable.As)
 			}
-
-			mySrcTable := base.SrcTable{
-				//Table:      tdata,
-				Name:       name,
-				UsedFields: map[string]bool{},
+			mySrcTable, built, err := openTable(name, tdata)
+			if err != nil {
+				return nil, err
 			}
-
-			vo := reflect.ValueOf(tdata)
-			kind := vo.Kind()
-			var structForFieldWalking interface{}
-			if kind == reflect.Slice && vo.Type().Elem().Kind() == reflect.Struct {
-				mySrcTable.Table = base.NewSliceOfStructRP(tdata)
-				structForFieldWalking = reflect.New(vo.Type().Elem()).Interface()
-			} else if kind == reflect.Struct {
-				s := reflect.MakeSlice(reflect.SliceOf(vo.Type()), 1, 1)
-				s.Index(0).Set(vo)
-				mySrcTable.Table = base.NewSliceOfStructRP(s.Interface())
-				structForFieldWalking = tdata
-			} else if kind == reflect.Chan {
-				if reflect.TypeOf(tdata).Elem().Kind() != reflect.Struct {
-					return nil, fmt.Errorf("Channel tables can only be of structs, TODO fixme")
-				}
-				mySrcTable.Table = base.NewChanOfStructRP(tdata)
-				structForFieldWalking = reflect.New(vo.Type().Elem()).Interface()
-			} else { // TODO support []map[string]interface{}
-				return nil, fmt.Errorf("unsupported type for table %s", string(name))
-			}
-
-			// TODO MAKE SAFER FOR NULLS
-			for _, f := range structs.Fields(structForFieldWalking) {
-				if f.IsExported() {
-					mySrcTable.Fields = append(mySrcTable.Fields, f.Name())
-				} else {
-					mySrcTable.HasPrivateFields = true
-				}
-			}
-
-			f.src[mySrcTable.Name] = &mySrcTable
+			f.src[mySrcTable.Name] = mySrcTable
 
 			j := &joinElement{
-				table:     &mySrcTable,
-				from:      nil,
-				condition: nil,
+				table: mySrcTable,
+				open: func(run *expr.Run) (base.RowProvider, error) {
+					tdata, ok := run.Obj.Table(tableName)
+					if !ok {
+						return nil, fmt.Errorf("missing table %s", tableName)
+					}
+					t, l, err := openTable(name, tdata)
+					if err != nil {
+						return nil, err
+					}
+					if !reflect.DeepEqual(l, built) {
+						return nil, fmt.Errorf("table %s is not laid out as the one the query was built on", name)
+					}
+					return t.Table, nil
+				},
 			}
 			f.joinElements = append(f.joinElements, j)
 			return j, nil
 		case *sqlparser.Subquery:
 			sub := aliasedTable.Expr.(*sqlparser.Subquery)
-			chOut, chCol := GetChan(sub.Select, f.obj, context.Background())
+			q, err := compile(sub.Select, f.obj, nil)
+			if err != nil {
+				return nil, err
+			}
 			// Determine struct shape
 			fields := []reflect.StructField{}
-			fieldNames := <-chCol
-			for _, v := range fieldNames {
-				fields = append(fields, reflect.StructField{Name: v, Type: reflect.TypeOf([]interface{}{}).Elem()})
-			}
-			symChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.StructOf(fields)), 0)
-			rp := base.NewChanOfStructRP(symChan.Interface())
-			go func() {
-				defer symChan.Close()
-				// live-convert structs for the row-provider.
-				for resMap := range chOut {
-					if resMap.Err != nil {
-						rp.(base.CanSetError).SetError(resMap.Err)
-						return // TODO how to pass error up?
-					}
-					s := reflect.New(reflect.StructOf(fields)).Elem()
-					for i, v := range resMap.Item {
-						s.FieldByIndex([]int{i}).Set(reflect.ValueOf(v))
-					}
-					base.Debug("subquery FROM sending ", pretty.Sprint(s))
-					symChan.Send(s)
-				}
-			}()
-			t := &base.SrcTable{
-				Table:      rp,
+			fieldTypes := map[string]base.ColType{}
+			for i, ct := range q.colTypes {
+				fieldTypes[q.colNames[i]] = ct
+			}
+			for i, v := range q.colNames { // column names needn't be Go names
+				fields = append(fields, reflect.StructField{
+					Name: "F" + strconv.Itoa(i),
+					Type: reflect.TypeOf([]interface{}{}).Elem(),
+					Tag:  reflect.StructTag("nodb:" + strconv.Quote(v)),
+				})
+			}
+			rowType := reflect.StructOf(fields)
+			t := &base.SrcTable{ // runs read the rows open gives them
+				Table:      base.NewSliceOfStructRP(reflect.MakeSlice(reflect.SliceOf(rowType), 0, 0).Interface()),
 				Name:       string(aliasedTable.As),
 				UsedFields: map[string]bool{},
-				Fields:     fieldNames,
+				Fields:     q.colNames,
+				FieldTypes: fieldTypes,
 			}
 			f.src[t.Name] = t
-			j := &joinElement{table: t}
+			j := &joinElement{
+				table: t,
+				open: func(run *expr.Run) (base.RowProvider, error) {
+					chOut := q.Start(run.Obj, run.Ctx, nil)
+					symChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, rowType), 0)
+					rp := base.NewChanOfStructRP(symChan.Interface())
+					go func() {
+						defer symChan.Close()
+						// live-convert structs for the row-provider.
+						for resMap := range chOut {
+							if resMap.Err != nil {
+								rp.(base.CanSetError).SetError(resMap.Err)
+								return // TODO how to pass error up?
+							}
+							s := reflect.New(rowType).Elem()
+							for i, v := range resMap.Item {
+								if v != nil { // NULL stays the zero interface{}
+									s.Field(i).Set(reflect.ValueOf(v))
+								}
+							}
+							base.Debug("subquery FROM sending ", pretty.Sprint(s))
+							chosen, _, _ := reflect.Select([]reflect.SelectCase{
+								{Dir: reflect.SelectSend, Chan: symChan, Send: s},
+								{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(run.Ctx.Done())},
+							})
+							if chosen == 1 {
+								return
+							}
+						}
+					}()
+					return rp, nil
+				},
+			}
 			f.joinElements = append(f.joinElements, j)
 			return j, nil
 		}
@@ -203,7 +288,139 @@ func (f *from) MakeJoinElement(table sqlparser.TableExpr) (*joinElement, error)
 	return nil, nil
 }
 
-// TODO Later: accept "table0 sorted .b.c desc" to help the planner
+// layout is what a table must keep for a query built on it to read it
+type layout struct {
+	fields   []string
+	types    map[string]base.ColType // nil when found from the rows
+	nullable bool
+	sortedBy []base.SortKey
+}
+
+// openTable readies tdata to be read as table name
+func openTable(name string, tdata interface{}) (*base.SrcTable, layout, error) {
+	var sortHint []string
+	if st, ok := tdata.(base.SortedTable); ok {
+		tdata, sortHint = st.Table, st.By
+	}
+
+	mySrcTable := base.SrcTable{
+		//Table:      tdata,
+		Name:       name,
+		UsedFields: map[string]bool{},
+	}
+
+	userTable, isUserTable := tdata.(base.Table)
+	vo := reflect.ValueOf(tdata)
+	if vo.Kind() == reflect.Ptr && vo.Elem().Kind() == reflect.Slice && !isUserTable { // writable table
+		vo = vo.Elem()
+		tdata = vo.Interface()
+	}
+	var declared []string
+	if mt, ok := tdata.(base.MapTable); ok {
+		declared = mt.Columns
+		vo = reflect.ValueOf(mt.Table)
+	}
+	mySrcTable.FieldTypes = map[string]base.ColType{}
+	typed := true
+	kind := vo.Kind()
+	var rowType reflect.Type
+	switch {
+	case isUserTable:
+		cols := userTable.Columns()
+		mySrcTable.Table = base.NewTableRP(userTable, cols)
+		for _, c := range cols {
+			mySrcTable.Fields = append(mySrcTable.Fields, c.Name)
+			mySrcTable.FieldTypes[c.Name] = base.ColType{Type: c.Type, Nullable: c.Nullable, NullKnown: true}
+		}
+	case kind == reflect.Slice && vo.Type().Elem() == reflect.TypeOf(map[string]interface{}{}):
+		rows := vo.Convert(reflect.TypeOf([]map[string]interface{}{})).Interface().([]map[string]interface{})
+		mySrcTable.Table = base.NewSliceOfMapRP(rows)
+		typed = false
+		if declared != nil {
+			mySrcTable.Fields = declared
+		} else {
+			mySrcTable.Fields, mySrcTable.FieldTypes = base.MapColumns(rows)
+		}
+	case kind == reflect.Slice:
+		if rowType = base.RowType(vo); rowType != nil {
+			mySrcTable.Table = base.NewSliceOfStructRP(vo.Interface())
+		}
+	case kind == reflect.Struct:
+		s := reflect.MakeSlice(reflect.SliceOf(vo.Type()), 1, 1)
+		s.Index(0).Set(vo)
+		mySrcTable.Table = base.NewSliceOfStructRP(s.Interface())
+		rowType = vo.Type()
+	case kind == reflect.Chan:
+		if rowType = base.RowType(vo); rowType == nil {
+			return nil, layout{}, fmt.Errorf("Channel table %s must be of structs or pointers to them", name)
+		}
+		mySrcTable.Table = base.NewChanOfStructRP(vo.Interface())
+	}
+	if mySrcTable.Table == nil {
+		return nil, layout{}, fmt.Errorf("unsupported type for table %s", string(name))
+	}
+
+	if rowType != nil {
+		if kind != reflect.Struct && rowType != vo.Type().Elem() {
+			mySrcTable.Nullable = true // a nil row is all NULLs
+		}
+		cols, hasPrivate := base.StructColumns(rowType)
+		for _, c := range cols {
+			mySrcTable.Fields = append(mySrcTable.Fields, c.Name)
+			mySrcTable.FieldTypes[c.Name] = base.FieldColType(c.Type)
+		}
+		mySrcTable.HasPrivateFields = hasPrivate
+	}
+	// copied: resolving a nested path adds it to the table's
+	l := layout{fields: append([]string{}, mySrcTable.Fields...), nullable: mySrcTable.Nullable}
+	if typed {
+		l.types = make(map[string]base.ColType, len(mySrcTable.FieldTypes))
+		for k, v := range mySrcTable.FieldTypes {
+			l.types[k] = v
+		}
+	}
+	if len(sortHint) > 0 {
+		keys, err := sortKeys(sortHint, mySrcTable.Fields)
+		if err != nil {
+			return nil, layout{}, fmt.Errorf("table %s: %s", name, err.Error())
+		}
+		mySrcTable.Table = base.NewSortedRP(mySrcTable.Table, keys)
+		l.sortedBy = keys
+	}
+	return &mySrcTable, l, nil
+}
+
+// sortKeys reads "field [ASC|DESC]" hints against a table's real-cased fields
+func sortKeys(hint []string, fields []string) ([]base.SortKey, error) {
+	keys := []base.SortKey{}
+	for _, h := range hint {
+		pcs := strings.Fields(h)
+		if len(pcs) == 0 || len(pcs) > 2 {
+			return nil, fmt.Errorf("bad sort hint %q", h)
+		}
+		key := base.SortKey{}
+		if len(pcs) == 2 {
+			switch strings.ToLower(pcs[1]) {
+			case "desc":
+				key.Desc = true
+			case "asc":
+			default:
+				return nil, fmt.Errorf("bad sort hint %q", h)
+			}
+		}
+		for _, fld := range fields {
+			if strings.ToLower(fld) == strings.ToLower(pcs[0]) {
+				key.Field = fld
+			}
+		}
+		if key.Field == "" {
+			return nil, fmt.Errorf("sort hint field %s not found", pcs[0])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 func (f *from) Do(t []sqlparser.TableExpr) error {
 	if len(t) != 1 {
 		return errors.New("cannot implicit cross-join yet")
@@ -220,11 +437,12 @@ func (f *from) Do(t []sqlparser.TableExpr) error {
 	return nil
 }
 
-func fromer(exprs sqlparser.TableExprs, obj base.Obj) (base.SrcTables, []*joinElement, error) {
+func fromer(exprs sqlparser.TableExprs, obj base.Obj, outer *expr.Outer) (base.SrcTables, []*joinElement, error) {
 	myFrom := from{
 		src: base.SrcTables{},
 		obj: obj,
 	}
-	myFrom.exprBuilder = expr.DefaultBuilder.Dup().Setup(myFrom.src, obj, GetChan)
+	myFrom.exprBuilder = expr.DefaultBuilder.Dup().Setup(myFrom.src, obj, SubqueryRunnerImpl{})
+	myFrom.exprBuilder.Outer = outer
 	return myFrom.src, myFrom.joinElements, myFrom.Do(exprs)
 }
@@ -15,6 +15,7 @@ type groupProcessor struct {
 	out   chan base.GetChanError
 	Wg    *sync.WaitGroup
 	so    *orderBySortable
+	start func() // run once SetOutputChan is done
 }
 
 func (g *groupProcessor) SetOutputChan(ch chan base.GetChanError) {
@@ -58,9 +59,20 @@ func makeGroupBy(
 		_, err := outrow(selectAgg)
 		return selectAgg.TokenRow, err
 	}
-	go func() {
+	gp.start = func() {
 		defer gp.Wg.Done()
-		for row := range gp.Input {
+		for {
+			var row row
+			var ok bool
+			select {
+			case row, ok = <-gp.Input:
+			case <-ctx.Done():
+				go toDevNull(gp.Input)
+				return
+			}
+			if !ok {
+				break
+			}
 			v, err := gb(row) // Get the GB expression list
 			if err != nil {
 				if strings.Contains(err.Error(), "1Select.") {
@@ -148,7 +160,7 @@ func makeGroupBy(
 					case <-ctx.Done():
 					}
 					return
-				} else if b.(bool) {
+				} else if hb, _ := b.(bool); hb { // NULL is not true
 					if havingNeedsSelectFields {
 						if gp.so != nil {
 							gp.so.AddRow(gr.selectAgg.TokenRow, sr)
@@ -172,7 +184,7 @@ func makeGroupBy(
 				}
 			}
 		}
-	}()
+	}
 	return &gp
 }
 
@@ -89,6 +89,12 @@ func makeSortable(tob sqlparser.OrderBy, eb *expr.ExpressionBuilder) (*orderBySo
 				if err != nil {
 					panic(err)
 				}
+				if leftV == nil || rightV == nil { // NULLs come first, last if DESC
+					if leftV == rightV {
+						continue
+					}
+					return (leftV == nil) == (t.ltIfAsc == lt)
+				}
 				isEq, err := eq.Evaluate(map[string]interface{}{"l": leftV, "r": rightV})
 				if err != nil {
 					panic(err)
@@ -6,52 +6,166 @@ import (
 
 	"github.com/snadrus/nodb/internal/base"
 	"github.com/snadrus/nodb/internal/expr"
+	"github.com/xwb1989/sqlparser"
 )
 
+// plan is a SELECT built once. Each Run reads its own copy of the tables.
 type plan struct {
-	rowMaker       rowMaker
-	where          condition
-	joins          []*joinElement
-	src            base.SrcTables
-	GroupProcessor *groupProcessor
-	so             *orderBySortable
-	context.Context
-	CancelCtx context.CancelFunc
+	rowMaker  rowMaker
+	where     condition
+	joins     []*joinElement
+	src       base.SrcTables
+	groupBy   func(ctx context.Context) *groupProcessor // a run's, nil without GROUP BY or aggregates
+	so        *orderBySortable                          // holds no rows: each run sorts its own
+	whereExpr sqlparser.BoolExpr                        // what remains of WHERE after pushDownWhere
+	colTypes  []base.ColType
+	distinct  bool
+	limit     bool
+	offset    int64
+	rowCount  int64
+	buffered  map[string]bool // tables read by subqueries in expressions, for bufferChans
 }
 
 type CancelWithError func(e error)
 
-func planQuery(out rowMaker, joins []*joinElement, whereCond condition, src base.SrcTables, ctx context.Context, cancelCtx context.CancelFunc) (*plan, error) {
+type joinStrategy int
+
+const (
+	nestedLoop joinStrategy = iota // every left row walks the whole table
+	hashJoin                       // table is read once into a map on the ON equalities
+	mergeJoin                      // both sides arrive sorted on an ON equality: one pass each
+)
+
+// orderedRef is a "table.Field" that a row stream is sorted by
+type orderedRef struct {
+	ref  string
+	desc bool
+}
+
+// sortedOn tells what je's output rows are ordered by, if known.
+// Every join strategy emits in the order of its left input.
+func (je *joinElement) sortedOn() []orderedRef {
+	if je.from != nil {
+		return je.from.sortedOn()
+	}
+	sp, ok := je.table.Table.(base.SortedRowProvider)
+	if !ok {
+		return nil
+	}
+	res := []orderedRef{}
+	for _, k := range sp.SortedBy() {
+		res = append(res, orderedRef{je.table.Name + "." + k.Field, k.Desc})
+	}
+	return res
+}
+
+// pickMergeKey finds an ON equality that both sides are sorted on
+func (je *joinElement) pickMergeKey() (keyIdx int, desc bool, ok bool) {
+	sp, isSorted := je.table.Table.(base.SortedRowProvider)
+	leftOrder := je.from.sortedOn()
+	if !isSorted || len(sp.SortedBy()) == 0 || len(leftOrder) == 0 {
+		return 0, false, false
+	}
+	mine := sp.SortedBy()[0]
+	for i, k := range je.equiKeys {
+		if k.leftRef == leftOrder[0].ref && k.rightRef == je.table.Name+"."+mine.Field &&
+			leftOrder[0].desc == mine.Desc {
+			return i, mine.Desc, true
+		}
+	}
+	return 0, false, false
+}
+
+func planQuery(out rowMaker, joins []*joinElement, whereCond condition, src base.SrcTables) (*plan, error) {
+	for _, je := range joins {
+		if je.condition == nil {
+			je.condition = goodCondition
+		}
+		je.strategy = nestedLoop
+		if je.from == nil || len(je.equiKeys) == 0 {
+			continue
+		}
+		je.strategy = hashJoin
+		if idx, desc, ok := je.pickMergeKey(); ok {
+			je.strategy = mergeJoin
+			je.mergeKey, je.mergeDesc = idx, desc
+		}
+	}
 	return &plan{
-		rowMaker:  out,
-		joins:     joins,
-		where:     whereCond,
-		Context:   ctx,
-		CancelCtx: cancelCtx,
+		rowMaker: out,
+		joins:    joins,
+		src:      src,
+		where:    whereCond,
 	}, nil
 }
 
 type row map[string]interface{}
 type chainType chan row
 
+// open copies the joins for run, reading the tables run has. Those must
+// be laid out as the ones the plan was built on.
+func (p *plan) open(run *expr.Run) ([]*joinElement, error) {
+	joins := make([]*joinElement, len(p.joins))
+	copies := map[*joinElement]*joinElement{}
+	for i, je := range p.joins {
+		rp, err := je.open(run)
+		if err != nil {
+			for _, opened := range joins[:i] {
+				closeTable(opened)
+			}
+			return nil, err
+		}
+		t := *je.table
+		t.Table = rp
+		c := *je
+		c.table, c.run = &t, run
+		if je.from != nil { // always an earlier one
+			c.from = copies[je.from]
+		}
+		copies[je] = &c
+		joins[i] = &c
+	}
+	return joins, nil
+}
+
 // Run a query plan
-func (p *plan) Run(ch chan base.GetChanError) {
+func (p *plan) Run(run *expr.Run, cancelCtx context.CancelFunc, ch chan base.GetChanError) {
+	ctx := run.Ctx
 	cancelWithError := func(e error) {
 		ch <- base.GetChanError{nil, e}
-		p.CancelCtx()
+		cancelCtx()
+	}
+	joins, err := p.open(run)
+	if err != nil {
+		cancelWithError(err) // stops what opened
+		return
 	}
-	for _, joinStep := range p.joins {
-		doNest(joinStep, p.Context, cancelWithError) // x*y strategy. Better ones later
+	for _, joinStep := range joins {
+		switch joinStep.strategy {
+		case hashJoin:
+			doHash(joinStep, ctx, cancelWithError)
+		case mergeJoin:
+			doMerge(joinStep, ctx, cancelWithError)
+		default:
+			doNest(joinStep, ctx, cancelWithError) // x*y strategy
+		}
 	}
 
-	if p.GroupProcessor != nil {
-		if p.so != nil {
-			p.GroupProcessor.SetSortOutput(p.so)
+	var so *orderBySortable
+	if p.so != nil {
+		so = &orderBySortable{lessFunc: p.so.lessFunc}
+	}
+	var gp *groupProcessor
+	if p.groupBy != nil {
+		gp = p.groupBy(ctx)
+		if so != nil {
+			gp.SetSortOutput(so)
 		}
-		p.GroupProcessor.SetOutputChan(ch)
+		gp.SetOutputChan(ch)
+		go gp.start()
 	}
 
-	joinOutput := p.joins[len(p.joins)-1].resultChan
+	joinOutput := joins[len(joins)-1].resultChan
 	for res := range joinOutput {
 		ok, err := p.where(res)
 		if err != nil {
@@ -60,11 +174,11 @@ func (p *plan) Run(ch chan base.GetChanError) {
 			// TODO clear the goroutine recursion
 			return
 		}
-		if !ok.(bool) { // WHERE says skip it
+		if b, _ := ok.(bool); !b { // WHERE says skip it, or is NULL
 			continue
 		}
 
-		if p.GroupProcessor == nil { // Simple non-agg select only
+		if gp == nil { // Simple non-agg select only
 			finalRow, err := p.rowMaker(res) // The SELECT processing
 			if err != nil {
 				ch <- base.GetChanError{nil, err}
@@ -72,25 +186,28 @@ func (p *plan) Run(ch chan base.GetChanError) {
 				return
 			}
 
-			if p.so != nil {
-				p.so.AddRow(res, finalRow)
+			if so != nil {
+				so.AddRow(res, finalRow)
 			} else {
 				select {
 				case ch <- base.GetChanError{finalRow, err}:
-				case <-p.Context.Done():
+				case <-ctx.Done():
 
 				}
 			}
 		} else {
-			p.GroupProcessor.Input <- res
+			select {
+			case gp.Input <- res:
+			case <-ctx.Done():
+			}
 		}
 	}
-	if p.GroupProcessor != nil {
-		close(p.GroupProcessor.Input)
-		p.GroupProcessor.Wg.Wait()
+	if gp != nil {
+		close(gp.Input)
+		gp.Wg.Wait()
 	}
-	if p.so != nil {
-		p.so.SortAndOutput(ch)
+	if so != nil {
+		so.SortAndOutput(ch)
 	}
 }
 
@@ -100,9 +217,11 @@ func toDevNull(ch chan row) {
 }
 
 // MakeGroupBy takes []Val maker and aggregate-possible HAVING bool.
-func (p *plan) MakeGroupBy(gb expr.E, SelectExpr *expr.ExpressionBuilder, HavingExpr *expr.ExpressionBuilder, outrow aggRowMaker, ctx context.Context) error {
+func (p *plan) MakeGroupBy(gb expr.E, SelectExpr *expr.ExpressionBuilder, HavingExpr *expr.ExpressionBuilder, outrow aggRowMaker) error {
 	// Also, SELECT expr aggregates needs dealing-with.
-	p.GroupProcessor = makeGroupBy(gb, SelectExpr, HavingExpr, outrow, ctx) // save it
+	p.groupBy = func(ctx context.Context) *groupProcessor { // each run groups its own rows
+		return makeGroupBy(gb, SelectExpr, HavingExpr, outrow, ctx)
+	}
 	return errors.New("MakeGroupBy TODO")
 }
 
@@ -18,9 +18,10 @@ type getInstructions struct {
 	addableToRow bool
 }
 
-func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMaker, aggRowMaker, []string, error) {
+func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMaker, aggRowMaker, []string, []base.ColType, error) {
 	var itemsToGet = []getInstructions{}
 	var colNames []string
+	var colTypes []base.ColType
 	avoidDupe := map[string]bool{}
 	selTbl := base.SrcTable{
 		Name:       "1Select", //impossible
@@ -35,7 +36,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 			if tname != nil {
 				t0, ok := builder.SrcTables[string(tname)] // get table from map
 				if !ok {
-					return nil, nil, nil, fmt.Errorf("Invalid tablename %s", tname)
+					return nil, nil, nil, nil, fmt.Errorf("Invalid tablename %s", tname)
 				}
 				tmpSet = base.SrcTables{string(tname): t0}
 			}
@@ -45,7 +46,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 				}
 				reflect.TypeOf(tbl.Table).Elem().NumField() // ONLY for []STRUCT{}
 				if tbl.HasPrivateFields {
-					return nil, nil, nil, fmt.Errorf("SELECT * FROM %s fails for private fields. Wrap %s's struct in another struct", tbl.Name, tbl.Name)
+					return nil, nil, nil, nil, fmt.Errorf("SELECT * FROM %s fails for private fields. Wrap %s's struct in another struct", tbl.Name, tbl.Name)
 				}
 				for _, fname := range tbl.Fields {
 					if _, ok := avoidDupe[fname]; ok {
@@ -55,6 +56,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 					tbl.UsedFields[fname] = true
 					func(fullname string) {
 						colNames = append(colNames, fname)
+						colTypes = append(colTypes, tbl.FieldType(fname))
 						itemsToGet = append(itemsToGet, getInstructions{
 							as: fname,
 							E: func(row map[string]interface{}) (interface{}, error) {
@@ -82,7 +84,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 			avoidDupe[eAs] = true
 			expE, err := builder.ExprToE(exp2.Expr)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 			addableToRow := false
 			if len(eAs) > 0 { // add to src table for GROUPBY, HAVING, ORDERBY
@@ -90,6 +92,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 				addableToRow = true
 			}
 			colNames = append(colNames, eAs)
+			colTypes = append(colTypes, builder.TypeOf(exp2.Expr))
 			itemsToGet = append(itemsToGet, getInstructions{
 				as:           eAs,
 				E:            expE,
@@ -142,7 +145,7 @@ func doSelect(s sqlparser.SelectExprs, builder *expr.ExpressionBuilder) (rowMake
 
 	builder.SrcTables["1Select"] = &selTbl
 
-	return r, rAgg, colNames, nil
+	return r, rAgg, colNames, colTypes, nil
 }
 
 func selRemoveNamedItemsTable(sourceTables base.SrcTables) {
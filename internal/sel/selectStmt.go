@@ -2,11 +2,15 @@ package sel
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/mitchellh/mapstructure"
@@ -18,16 +22,22 @@ import (
 type Rows struct {
 	colNamesCh    chan []string
 	colNamesCache []string
+	colTypesCh    chan []base.ColType
+	colTypesCache []base.ColType
 	ch            chan base.GetChanError
+	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
-func DoAry(tree sqlparser.SelectStatement, src base.Obj, ctx context.Context) (driver.Rows, error) {
-	ctx, cancel := context.WithCancel(ctx)
-	ch, colNamesCh := GetChan(tree, src, ctx)
+// DoAry streams a SELECT for database/sql. Rows.Close calls cancel, which must end ctx.
+func DoAry(tree sqlparser.SelectStatement, src base.Obj, ctx context.Context, cancel context.CancelFunc) (driver.Rows, error) {
+	colTypesCh := make(chan []base.ColType, 1)
+	ch, colNamesCh := startChan(tree, src, ctx, colTypesCh)
 	return &Rows{
 		colNamesCh: colNamesCh,
+		colTypesCh: colTypesCh,
 		ch:         ch,
+		ctx:        ctx,
 		cancel:     cancel,
 	}, nil
 }
@@ -41,6 +51,66 @@ func (r *Rows) Columns() []string {
 	return r.colNamesCache
 }
 
+func (r *Rows) colType(index int) base.ColType {
+	if r.colTypesCache == nil {
+		r.Columns() // the names come first
+		r.colTypesCache = <-r.colTypesCh
+	}
+	if index < len(r.colTypesCache) {
+		return r.colTypesCache[index]
+	}
+	return base.ColType{}
+}
+
+var typeAny = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// ColumnTypeScanType is the Go type of the column's values
+func (r *Rows) ColumnTypeScanType(index int) reflect.Type {
+	if t := r.colType(index).Type; t != nil {
+		return t
+	}
+	return typeAny
+}
+
+// ColumnTypeDatabaseTypeName names the column's type SQL-style, or "" if unsure
+func (r *Rows) ColumnTypeDatabaseTypeName(index int) string {
+	return TypeName(r.colType(index).Type)
+}
+
+func (r *Rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	ct := r.colType(index)
+	return ct.Nullable, ct.NullKnown
+}
+
+var typeTime = reflect.TypeOf(time.Time{})
+
+// TypeName names a Go type SQL-style: INTEGER, REAL, TEXT, BOOLEAN,
+// TIMESTAMP or BLOB. Others are "".
+func TypeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	if t == typeTime {
+		return "TIMESTAMP"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	case reflect.String:
+		return "TEXT"
+	case reflect.Bool:
+		return "BOOLEAN"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BLOB"
+		}
+	}
+	return ""
+}
+
 func (r *Rows) Close() error {
 	r.cancel()
 	return nil
@@ -53,6 +123,9 @@ func (r *Rows) Next(dest []driver.Value) error {
 		return chanError.Err
 	}
 	if !ok {
+		if err := r.ctx.Err(); err != nil { // cut short, not finished
+			return err
+		}
 		return io.EOF
 	}
 	for i, v := range chanError.Item {
@@ -63,71 +136,260 @@ func (r *Rows) Next(dest []driver.Value) error {
 
 // Do SELECT
 func Do(tree sqlparser.SelectStatement, result interface{}, src base.Obj) error {
-	ch, chColNames := GetChan(tree, src, context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // a single-row result may stop early
+	ch, chColNames := GetChan(tree, src, ctx)
+	return collect(ch, chColNames, result)
+}
+
+// ErrManyRows is from a single-row result given more than one row
+var ErrManyRows = errors.New("sql: more than one row in result")
+
+// collect copies rows from a GetChan-like stream into result: a pointer to
+// a slice, to a map keyed by the first column, or to one row (struct,
+// map[string]interface{} or scalar) that must get exactly one. A chan
+// result is sent each row, then closed.
+func collect(ch chan base.GetChanError, chColNames chan []string, result interface{}) error {
 	var colNames []string
 	rt := reflect.ValueOf(result)
-	if rt.Kind() != reflect.Ptr {
-		return fmt.Errorf("Result must be a pointer. TODO: allow single rows")
-	}
-	rSlice := rt.Elem()
-	if rSlice.Kind() != reflect.Slice {
-		return fmt.Errorf("Result must be a pointer to a slice. TODO: allow single rows")
+	var put func(item []interface{}) error
+	one := false
+	switch {
+	case rt.Kind() == reflect.Chan:
+		if rt.Type().ChanDir()&reflect.SendDir == 0 {
+			return fmt.Errorf("Result channel must allow sends")
+		}
+		defer rt.Close()
+		put = func(item []interface{}) error {
+			v := reflect.New(rt.Type().Elem())
+			if err := DecodeRow(colNames, item, v.Interface()); err != nil {
+				return err
+			}
+			rt.Send(v.Elem())
+			return nil
+		}
+	case rt.Kind() != reflect.Ptr || rt.IsNil():
+		return fmt.Errorf("Result must be a pointer or a channel")
+	case rt.Elem().Kind() == reflect.Slice && rt.Elem().Type().Elem().Kind() != reflect.Uint8: // []byte is a scalar
+		rSlice := rt.Elem()
+		put = func(item []interface{}) error {
+			v := reflect.New(rSlice.Type().Elem())
+			if err := DecodeRow(colNames, item, v.Interface()); err != nil {
+				return err
+			}
+			rSlice.Set(reflect.Append(rSlice, v.Elem()))
+			return nil
+		}
+	case rt.Elem().Kind() == reflect.Map && rt.Elem().Type() != reflect.TypeOf(map[string]interface{}{}):
+		put = keyedPut(rt.Elem(), &colNames)
+	default:
+		one = true
+		put = func(item []interface{}) error {
+			return DecodeRow(colNames, item, result)
+		}
 	}
-	unit := rSlice.Type().Elem()
+	n := 0
 	for complex := range ch {
 		base.Debug("got", complex.Item)
 		if complex.Err != nil {
 			base.Debug("got err", complex.Err)
 			return complex.Err
 		}
-		v := reflect.New(unit)
+		if n++; one && n > 1 {
+			return ErrManyRows
+		}
+		if colNames == nil {
+			colNames = <-chColNames
+		}
+		if err := put(complex.Item); err != nil {
+			return err
+		}
+	}
+	if one && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
 
-		// TODO augment copier to support source & dest as map[string]interface{}
-		// complex.item.(type) === map[string]interface{}
-		// v.Interface().(type) is either the same (set equal) or struct
+// keyedPut fills map m by each row's first column. A struct or
+// map[string]interface{} value gets the whole row, others the second column.
+func keyedPut(m reflect.Value, colNames *[]string) func(item []interface{}) error {
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	kt, vt := m.Type().Key(), m.Type().Elem()
+	seen := map[interface{}]bool{}
+	return func(item []interface{}) error {
+		k := reflect.New(kt).Elem()
+		if err := base.Assign(k, item[0]); err != nil {
+			return err
+		}
+		if seen[k.Interface()] {
+			return fmt.Errorf("Duplicate key %v in result map", item[0])
+		}
+		seen[k.Interface()] = true
+		v := reflect.New(vt)
+		cols, vals := *colNames, item
+		if vt.Kind() != reflect.Map && (vt.Kind() != reflect.Struct ||
+			len(item) == 2 && item[1] != nil && base.Assignable(reflect.TypeOf(item[1]), vt)) {
+			cols, vals = cols[1:], vals[1:]
+		}
+		if err := DecodeRow(cols, vals, v.Interface()); err != nil {
+			return err
+		}
+		m.SetMapIndex(k, v.Elem())
+		return nil
+	}
+}
 
-		switch v.Interface().(type) {
-		case map[string]interface{}:
-			rSlice.Set(reflect.Append(rSlice, reflect.ValueOf(complex.Item)))
-		default:
-			tmp := make(map[string]interface{})
-			if colNames == nil {
-				colNames = <-chColNames
+// DecodeRow copies a row into dest: a pointer to a struct, whose fields
+// take columns by name, to a map[string]interface{}, or to a scalar such
+// as an int for a one-column row.
+func DecodeRow(colNames []string, item []interface{}, dest interface{}) error {
+	if m, ok := dest.(*map[string]interface{}); ok {
+		*m = make(map[string]interface{}, len(item))
+		for i, v := range item {
+			(*m)[colNames[i]] = v
+		}
+		return nil
+	}
+	d := reflect.ValueOf(dest).Elem()
+	if d.Kind() == reflect.Struct && !(len(item) == 1 && item[0] != nil && base.Assignable(reflect.TypeOf(item[0]), d.Type())) {
+		byCol := destFields(d.Type())
+		tmp := make(map[string]interface{}, len(item))
+		for i, v := range item {
+			col := strings.ToLower(colNames[i])
+			name, ok := byCol[col]
+			if dot := strings.LastIndex(col, "."); !ok && dot >= 0 { // t.a or address.city
+				name, ok = byCol[col[dot+1:]]
 			}
-			for i, v := range complex.Item {
-				tmp[colNames[i]] = v
+			if ok {
+				tmp[name] = v
 			}
-			mapstructure.Decode(tmp, v.Interface())
-			rSlice.Set(reflect.Append(rSlice, reflect.Indirect(v)))
 		}
+		return mapstructure.Decode(tmp, dest)
 	}
-	//RT needs to point at new RE
-	rt.Elem().Set(rSlice)
-	return nil
+	if len(item) != 1 {
+		return fmt.Errorf("Cannot put %d columns in a %s", len(item), d.Type())
+	}
+	return base.Assign(d, item[0])
 }
 
-type condition expr.E
+var destFieldsCache sync.Map // reflect.Type -> map[string]string
 
-type SubqueryRunnerImpl struct {
+// destFields maps a result struct's lowercased column names to its Go field
+// names, for mapstructure
+func destFields(t reflect.Type) map[string]string {
+	if m, ok := destFieldsCache.Load(t); ok {
+		return m.(map[string]string)
+	}
+	cols, _ := base.StructColumns(t)
+	m := make(map[string]string, len(cols))
+	for _, c := range cols {
+		m[strings.ToLower(c.Name)] = t.Field(c.Index[0]).Name
+	}
+	destFieldsCache.Store(t, m)
+	return m
 }
 
+type condition expr.E
+
 // GetChan for when you want a stream of results
 func GetChan(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Context) (chOut chan base.GetChanError, colCh chan []string) {
-	ch := make(chan base.GetChanError, 20)
-	chColNames := make(chan []string, 1)
-	var cancelCtx context.CancelFunc
-	ctx, cancelCtx = context.WithCancel(ctx)
+	return startChan(selStmt, src, ctx, nil)
+}
+
+// startChan is GetChan also sending column types on chTypes, if not nil.
+// Like the names, they are sent once built, or empty on error.
+func startChan(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Context, chTypes chan []base.ColType) (chan base.GetChanError, chan []string) {
+	q, err := compile(selStmt, src, nil)
+	if err != nil {
+		ch := make(chan base.GetChanError, 1)
+		ch <- base.GetChanError{nil, err}
+		close(ch)
+		chColNames := make(chan []string, 1)
+		chColNames <- []string{} // as for any other error
+		if chTypes != nil {
+			chTypes <- nil
+		}
+		return ch, chColNames
+	}
+	if chTypes != nil {
+		chTypes <- q.colTypes
+	}
+	return q.GetChan(src, ctx)
+}
+
+// Query is a SELECT built once: its plan and expressions are bound to the
+// column layout of the tables it was built on. It can then run any number
+// of times, at once too, on tables laid out the same. A run on others is
+// refused.
+type Query struct {
+	plan        *plan  // nil for a UNION
+	left, right *Query // a UNION's
+	colNames    []string
+	colTypes    []base.ColType
+}
+
+// Compile builds a SELECT against src's tables, args and funcs
+func Compile(selStmt sqlparser.SelectStatement, src base.Obj) (*Query, error) {
+	return compile(selStmt, src, nil)
+}
+
+// compile is Compile for a subquery that may read outer's columns
+func compile(selStmt sqlparser.SelectStatement, src base.Obj, outer *expr.Outer) (*Query, error) {
 	switch u := selStmt.(type) {
 	case *sqlparser.Union:
 		if !(u.Type == sqlparser.AST_UNION || u.Type == sqlparser.AST_UNION_ALL) {
-			ch <- base.GetChanError{nil, errors.New("Simple Union only, TODO")}
-			return ch, chColNames
+			return nil, errors.New("Simple Union only, TODO")
 		}
-		selStmt = u.Left
-		ch2, _ := GetChan(u.Right, src, ctx)
-		defer func() {
-			chOut = make(chan base.GetChanError) //ipso-facto replace
-		}()
+		l, err := compile(u.Left, src, outer)
+		if err != nil {
+			return nil, err
+		}
+		r, err := compile(u.Right, src, outer)
+		if err != nil {
+			return nil, err
+		}
+		return &Query{left: l, right: r, colNames: l.colNames, colTypes: unionTypes(l.colTypes, r.colTypes)}, nil
+	case *sqlparser.Select:
+		p, colNames, err := buildPlan(u, src, outer)
+		if err != nil {
+			return nil, err
+		}
+		return &Query{plan: p, colNames: colNames, colTypes: p.colTypes}, nil
+	}
+	return nil, errors.New("Unknown subquery type")
+}
+
+// Types are the column types
+func (q *Query) Types() []base.ColType {
+	return q.colTypes
+}
+
+// GetChan runs q on src like GetChan
+func (q *Query) GetChan(src base.Obj, ctx context.Context) (chan base.GetChanError, chan []string) {
+	chColNames := make(chan []string, 1)
+	chColNames <- q.colNames
+	return q.Start(src, ctx, nil), chColNames
+}
+
+// Do runs q on src like Do
+func (q *Query) Do(result interface{}, src base.Obj) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // a single-row result may stop early
+	ch, chColNames := q.GetChan(src, ctx)
+	return collect(ch, chColNames, result)
+}
+
+// Start streams q's rows from src's tables until ctx ends. Refs to outer
+// columns, in a correlated subquery, read outerRow.
+func (q *Query) Start(src base.Obj, ctx context.Context, outerRow map[string]interface{}) chan base.GetChanError {
+	ctx, cancelCtx := context.WithCancel(ctx)
+	if q.plan == nil {
+		left := q.left.Start(src, ctx, outerRow)
+		ch2 := q.right.Start(src, ctx, outerRow)
+		chOut := make(chan base.GetChanError) // merges left & ch2 for our caller
 		go func() {
 			defer close(chOut)
 			// add to ch. IF error in either, cancel other
@@ -141,7 +403,7 @@ func GetChan(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Contex
 			}
 			for {
 				select {
-				case v, ok := <-ch: // Read Left
+				case v, ok := <-left: // Read Left
 					if !ok {
 						drain(ch2)
 						return
@@ -152,7 +414,7 @@ func GetChan(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Contex
 					chOut <- v
 				case v, ok := <-ch2: // Read Right
 					if !ok {
-						drain(ch)
+						drain(left)
 						return
 					}
 					if v.Err != nil {
@@ -162,165 +424,205 @@ func GetChan(selStmt sqlparser.SelectStatement, src base.Obj, ctx context.Contex
 				}
 			}
 		}()
+		return chOut
 	}
-	tree := selStmt.(*sqlparser.Select)
 
+	ch := make(chan base.GetChanError, 20)
+	out := ch // the goroutine swaps ch for stage inputs
 	go func() {
-		chReturnSimple := func() error {
+		plan := q.plan
+		src, err := bufferChans(plan.buffered, src, ctx)
+		if err != nil {
+			ch <- base.GetChanError{nil, err}
+			close(ch)
+			return
+		}
+		if plan.distinct {
+			ch = distinctStage(ch, ctx)
+		}
+		if plan.limit {
+			ch = limitStage(ch, plan.offset, plan.rowCount, ctx, cancelCtx)
+		}
+		plan.Run(&expr.Run{Obj: src, Ctx: ctx, Outer: outerRow}, cancelCtx, ch)
+		close(ch) //Lets CH redefined by Limit
+	}()
+	return out
+}
 
-			sourceTables, joins, err := fromer(tree.From, src)
-			if err != nil {
-				return err
-			}
-			WhereBuilder := expr.DefaultBuilder.Dup().Setup(sourceTables, src, GetChan)
+// unionTypes are the column types of l UNION r
+func unionTypes(l, r []base.ColType) []base.ColType {
+	if len(l) != len(r) {
+		return nil
+	}
+	res := make([]base.ColType, len(l))
+	for i := range l {
+		res[i] = base.ColType{
+			Nullable:  l[i].Nullable || r[i].Nullable,
+			NullKnown: l[i].NullKnown && r[i].NullKnown,
+		}
+		if l[i].Type == r[i].Type {
+			res[i].Type = l[i].Type
+		}
+	}
+	return res
+}
 
-			if tree.Where != nil {
-				WhereBuilder.Expr, err = WhereBuilder.MakeBool(tree.Where.Expr)
-				if err != nil {
-					return err
-				}
-			}
+// buildPlan readies everything a SELECT needs. Nothing runs until plan.Run.
+func buildPlan(tree *sqlparser.Select, src base.Obj, outer *expr.Outer) (*plan, []string, error) {
+	sourceTables, joins, err := fromer(tree.From, src, outer)
+	if err != nil {
+		return nil, nil, err
+	}
+	WhereBuilder := expr.DefaultBuilder.Dup().Setup(sourceTables, src, SubqueryRunnerImpl{})
+	WhereBuilder.Outer = outer
+
+	var residualWhere sqlparser.BoolExpr
+	if tree.Where != nil {
+		WhereBuilder.Expr, residualWhere, err = pushDownWhere(tree.Where.Expr, joins, WhereBuilder)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	selectBuilder := WhereBuilder.Dup()
+	selectBuilder.AllowAggregates()
+
+	outputTypes, aggOutputer, colNames, colTypes, err := doSelect(tree.SelectExprs, selectBuilder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DoSelect error: %v", err)
+	}
 
-			selectBuilder := WhereBuilder.Dup()
-			selectBuilder.AllowAggregates()
+	plan, err := planQuery(outputTypes, joins, condition(WhereBuilder.Expr), sourceTables)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Plan err: %v", err)
+	}
+	plan.whereExpr = residualWhere
+	plan.colTypes = colTypes
 
-			outputTypes, aggOutputer, colNames, err := doSelect(tree.SelectExprs, selectBuilder)
+	if tree.GroupBy != nil {
+		groupByExprs, err := WhereBuilder.MakeSlice(tree.GroupBy)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tree.Having != nil {
+			havingBuilder := WhereBuilder.Dup()
+			havingBuilder.AllowAggregates()
+			havingBuilder.SrcTables = base.SrcTables{"1Select": selectBuilder.SrcTables["1Select"]}
+			havingBuilder.Expr, err = havingBuilder.MakeBool(tree.Having.Expr)
 			if err != nil {
-				return fmt.Errorf("DoSelect error: %v", err)
+				return nil, nil, fmt.Errorf("HAVING expression error: %s", err.Error())
 			}
-			chColNames <- colNames
 
-			plan, err := planQuery(outputTypes, joins, condition(WhereBuilder.Expr), sourceTables, ctx, cancelCtx)
-			if err != nil {
-				return fmt.Errorf("Plan err: %v", err)
+			plan.MakeGroupBy(groupByExprs, selectBuilder, havingBuilder, aggOutputer)
+		} else {
+			plan.MakeGroupBy(groupByExprs, selectBuilder, nil, aggOutputer)
+		}
+		// TODO FUTURE index on fields of interest & traverse in that order.
+	} else {
+		if tree.Having != nil {
+			return nil, nil, errors.New("GROUPBY needed for HAVING")
+		}
+		if 0 != len(*selectBuilder.AggProcessing) {
+			oneBigGroup := func(row map[string]interface{}) (interface{}, error) {
+				return []interface{}{}, nil
 			}
 
-			if tree.GroupBy != nil {
-				groupByExprs, err := WhereBuilder.MakeSlice(tree.GroupBy)
-				if err != nil {
-					return err
-				}
-				if tree.Having != nil {
-					havingBuilder := WhereBuilder.Dup()
-					havingBuilder.AllowAggregates()
-					havingBuilder.SrcTables = base.SrcTables{"1Select": selectBuilder.SrcTables["1Select"]}
-					havingBuilder.Expr, err = havingBuilder.MakeBool(tree.Having.Expr)
-					if err != nil {
-						return fmt.Errorf("HAVING expression error: %s", err.Error())
-					}
+			plan.MakeGroupBy(oneBigGroup, selectBuilder, nil, aggOutputer)
+		}
+	}
 
-					plan.MakeGroupBy(groupByExprs, selectBuilder, havingBuilder, aggOutputer, ctx)
-				} else {
-					plan.MakeGroupBy(groupByExprs, selectBuilder, nil, aggOutputer, ctx)
-				}
-				// TODO FUTURE index on fields of interest & traverse in that order.
-			} else {
-				if tree.Having != nil {
-					return errors.New("GROUPBY needed for HAVING")
-				}
-				if 0 != len(*selectBuilder.AggProcessing) {
-					oneBigGroup := func(row map[string]interface{}) (interface{}, error) {
-						return []interface{}{}, nil
-					}
+	if tree.OrderBy != nil { // "Where" cannot access 1Select, "OrderBy" must
+		base.Debug("available tables:", WhereBuilder.SrcTables)
+		so, err := makeSortable(tree.OrderBy, WhereBuilder)
+		if err != nil {
+			return nil, nil, fmt.Errorf("OrderBy parse: %s", err.Error())
+		}
+		plan.MakeOrderBy(so)
+	}
 
-					plan.MakeGroupBy(oneBigGroup, selectBuilder, nil, aggOutputer, ctx)
-				}
-			}
+	plan.distinct = tree.Distinct != ""
 
-			if tree.OrderBy != nil { // "Where" cannot access 1Select, "OrderBy" must
-				base.Debug("available tables:", WhereBuilder.SrcTables)
-				so, err := makeSortable(tree.OrderBy, WhereBuilder)
-				if err != nil {
-					return fmt.Errorf("OrderBy parse: %s", err.Error())
-				}
-				plan.MakeOrderBy(so)
-			}
+	if tree.Limit != nil {
+		offsetI, rowCtI, err := tree.Limit.Limits()
+		if err != nil {
+			return nil, nil, err
+		}
+		plan.limit = true
+		plan.offset, _ = offsetI.(int64)
+		plan.rowCount, _ = rowCtI.(int64)
+	}
+	if tree.Lock != "" {
+		return nil, nil, errors.New("No support for Lock")
+	}
 
-			if tree.Distinct != "" {
-				out := ch
-				ch = make(chan base.GetChanError)
-				go func() {
-					defer close(out)
-					done := ctx.Done() // an error
-					already := map[string]bool{}
-					var stringver string
-					var ok bool
-					var v base.GetChanError
-					for {
-						select {
-						case v, ok = <-ch:
-							if v.Err != nil {
-								out <- v
-								return
-							}
-							if !ok {
-								return
-							}
-							stringver = pretty.Sprint(v)
-							if _, ok = already[stringver]; ok {
-								continue
-							}
-							out <- v
-							already[stringver] = true
-						case <-done:
-							return
-						}
-					}
-				}()
-			}
+	plan.buffered = map[string]bool{}
+	subqueryTables(reflect.ValueOf(tree), plan.buffered)
 
-			if tree.Limit != nil {
-				out := ch
-				ch = make(chan base.GetChanError)
-				offsetI, rowCtI, err := tree.Limit.Limits()
-				if err != nil {
-					return err
+	selRemoveNamedItemsTable(sourceTables)
+	return plan, colNames, nil
+}
+
+// distinctStage passes on only rows not seen before. Write to the returned chan.
+func distinctStage(out chan base.GetChanError, ctx context.Context) chan base.GetChanError {
+	ch := make(chan base.GetChanError)
+	go func() {
+		defer close(out)
+		done := ctx.Done() // an error
+		already := map[string]bool{}
+		var stringver string
+		var ok bool
+		var v base.GetChanError
+		for {
+			select {
+			case v, ok = <-ch:
+				if v.Err != nil {
+					out <- v
+					return
 				}
-				go func() {
-					defer close(out)
-					done := ctx.Done()
-					if offsetI != nil {
-						for a := 0; a < offsetI.(int); a++ {
-							select {
-							case <-ch:
-							case <-done:
-								return
-							}
-						}
-					}
-					var v base.GetChanError
-					var ok bool
-					if rowCtI != nil {
-						for a := int64(0); a < rowCtI.(int64); a++ {
-							select {
-							case <-done:
-								return
-							case v, ok = <-ch: // "out" closed automatically
-								if !ok {
-									return
-								}
-								out <- v
-							}
-						}
-					}
-					cancelCtx()
-				}()
-			}
-			if tree.Lock != "" {
-				return errors.New("No support for Lock")
+				if !ok {
+					return
+				}
+				stringver = pretty.Sprint(v)
+				if _, ok = already[stringver]; ok {
+					continue
+				}
+				out <- v
+				already[stringver] = true
+			case <-done:
+				return
 			}
+		}
+	}()
+	return ch
+}
 
-			selRemoveNamedItemsTable(sourceTables)
-
-			plan.Run(ch)
-			return nil
+// limitStage skips offset rows then passes on rowCount. Write to the returned chan.
+func limitStage(out chan base.GetChanError, offset, rowCount int64, ctx context.Context, cancelCtx context.CancelFunc) chan base.GetChanError {
+	ch := make(chan base.GetChanError)
+	go func() {
+		defer close(out)
+		done := ctx.Done()
+		for a := int64(0); a < offset; a++ {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
 		}
-		err := chReturnSimple() // easier err handling
-		if err != nil {
-			ch <- base.GetChanError{nil, err}
-			chColNames <- []string{} // oft waited-on first
+		var v base.GetChanError
+		var ok bool
+		for a := int64(0); a < rowCount; a++ {
+			select {
+			case <-done:
+				return
+			case v, ok = <-ch: // "out" closed automatically
+				if !ok {
+					return
+				}
+				out <- v
+			}
 		}
-		close(ch) //Lets CH redefined by Limit
+		cancelCtx()
 	}()
-	return ch, chColNames
+	return ch
 }
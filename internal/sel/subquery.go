@@ -0,0 +1,198 @@
+package sel
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/expr"
+	"github.com/xwb1989/sqlparser"
+)
+
+// SubqueryRunnerImpl runs the subqueries expressions hold
+type SubqueryRunnerImpl struct {
+}
+
+func (SubqueryRunnerImpl) Compile(selStmt sqlparser.SelectStatement, src base.Obj, outer *expr.Outer) (expr.Subquery, error) {
+	return compile(selStmt, src, outer)
+}
+
+// SemiJoin turns EXISTS (SELECT .. FROM t WHERE t.x = outer.y AND <t only>)
+// into SELECT t.x FROM t WHERE <t only>, to list once and look outer.y up in.
+func (SubqueryRunnerImpl) SemiJoin(selStmt sqlparser.SelectStatement, src base.Obj, outer *expr.Outer) (sqlparser.SelectStatement, []sqlparser.ValExpr, bool) {
+	tree, isSelect := selStmt.(*sqlparser.Select)
+	if !isSelect || tree.Where == nil || tree.GroupBy != nil || tree.Having != nil || tree.Limit != nil {
+		return nil, nil, false
+	}
+	probe := &expr.Outer{SrcTables: outer.SrcTables, Parent: outer.Parent}
+	p, _, err := buildPlan(tree, src, probe)
+	if err != nil || p.groupBy != nil { // an aggregate always gives a row
+		return nil, nil, false
+	}
+	keys := sqlparser.SelectExprs{}
+	outerVals := []sqlparser.ValExpr{}
+	rest := []sqlparser.BoolExpr{}
+	for _, part := range splitAnd(tree.Where.Expr) {
+		inner, outside, ok := sides(part, p.src, outer.SrcTables)
+		if !ok {
+			return nil, nil, false
+		}
+		if !outside {
+			rest = append(rest, part)
+			continue
+		}
+		cmp, isCmp := part.(*sqlparser.ComparisonExpr)
+		if !isCmp || cmp.Operator != sqlparser.AST_EQ || !inner {
+			return nil, nil, false
+		}
+		lIn, lOut, _ := sides(cmp.Left, p.src, outer.SrcTables)
+		rIn, rOut, _ := sides(cmp.Right, p.src, outer.SrcTables)
+		switch {
+		case lIn && !lOut && rOut && !rIn:
+			keys = append(keys, &sqlparser.NonStarExpr{Expr: cmp.Left})
+			outerVals = append(outerVals, cmp.Right)
+		case rIn && !rOut && lOut && !lIn:
+			keys = append(keys, &sqlparser.NonStarExpr{Expr: cmp.Right})
+			outerVals = append(outerVals, cmp.Left)
+		default:
+			return nil, nil, false
+		}
+	}
+	if len(keys) == 0 { // not correlated by an equality
+		return nil, nil, false
+	}
+	q := *tree
+	q.SelectExprs = keys
+	q.Distinct = ""
+	q.OrderBy = nil
+	q.Where = nil
+	if len(rest) > 0 {
+		q.Where = &sqlparser.Where{Type: sqlparser.AST_WHERE, Expr: joinAnd(rest)}
+	}
+	return &q, outerVals, true
+}
+
+// sides tells if an expression reads the subquery's own tables and/or the
+// outer query's. Inner names win. ok is false if it reads anything else.
+func sides(node sqlparser.Expr, inner, outer base.SrcTables) (readsInner, readsOuter, ok bool) {
+	cols, ok := colRefs(node)
+	if !ok {
+		return false, false, false
+	}
+	for _, c := range cols {
+		if _, err := inner.ResolveRefAndMarkUsed(colRefName(c)); err == nil {
+			readsInner = true
+		} else if _, err := outer.ResolveRefAndMarkUsed(colRefName(c)); err == nil {
+			readsOuter = true
+		} else {
+			return false, false, false
+		}
+	}
+	return readsInner, readsOuter, true
+}
+
+// bufferChans reads into slices the chan tables named, those a query's
+// subqueries read, before the query reads any. Subqueries may run once per
+// row, and the query itself may read the same chan: all of them then share
+// one copy of its rows.
+func bufferChans(names map[string]bool, src base.Obj, ctx context.Context) (base.Obj, error) {
+	var res base.Obj
+	for k, t := range src {
+		if !names[strings.ToLower(k)] {
+			continue
+		}
+		sorted, isSorted := t.(base.SortedTable)
+		if isSorted {
+			t = sorted.Table
+		}
+		ch := reflect.ValueOf(t)
+		if ch.Kind() != reflect.Chan {
+			continue
+		}
+		rows := reflect.MakeSlice(reflect.SliceOf(ch.Type().Elem()), 0, 0)
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: ch},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		for {
+			chosen, r, ok := reflect.Select(cases)
+			if chosen == 1 {
+				return nil, ctx.Err()
+			}
+			if !ok {
+				break
+			}
+			rows = reflect.Append(rows, r)
+		}
+		if res == nil {
+			res = make(base.Obj, len(src))
+			for k2, v := range src {
+				res[k2] = v
+			}
+		}
+		res[k] = rows.Interface()
+		if isSorted {
+			sorted.Table = rows.Interface()
+			res[k] = sorted
+		}
+	}
+	if res == nil {
+		return src, nil
+	}
+	return res, nil
+}
+
+// subqueryTables collects the (lowercased) names of the tables read by the
+// subqueries in v's expressions. Subqueries in FROM run once, on their own.
+func subqueryTables(v reflect.Value, names map[string]bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		switch n := v.Interface().(type) {
+		case *sqlparser.AliasedTableExpr:
+			return
+		case *sqlparser.Subquery:
+			tableNames(reflect.ValueOf(n.Select), names)
+			return
+		}
+		subqueryTables(v.Elem(), names)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			subqueryTables(v.Field(i), names)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				subqueryTables(v.Index(i), names)
+			}
+		}
+	}
+}
+
+// tableNames collects the (lowercased) names of the tables under v
+func tableNames(v reflect.Value, names map[string]bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if tn, ok := v.Interface().(*sqlparser.TableName); ok {
+			names[strings.ToLower(string(tn.Name))] = true
+			return
+		}
+		tableNames(v.Elem(), names)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			tableNames(v.Field(i), names)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				tableNames(v.Index(i), names)
+			}
+		}
+	}
+}
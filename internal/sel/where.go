@@ -0,0 +1,172 @@
+package sel
+
+import (
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/expr"
+	"github.com/xwb1989/sqlparser"
+)
+
+// pushDownWhere hands each single-table part of an AND-ed WHERE to that
+// table's joinElement, so rows are dropped before joining. The remaining
+// parts are returned for checking on the fully joined row, with their source.
+// Tables on the NULL side of a LEFT JOIN keep their parts in the WHERE:
+// filtering first would produce NULL rows the WHERE must reject.
+func pushDownWhere(where sqlparser.BoolExpr, joins []*joinElement, eb *expr.ExpressionBuilder) (expr.E, sqlparser.BoolExpr, error) {
+	byTable := map[string]*joinElement{}
+	for _, je := range joins {
+		byTable[je.table.Name] = je
+	}
+	perTable := map[*joinElement][]sqlparser.BoolExpr{}
+	rest := []sqlparser.BoolExpr{}
+	for _, part := range splitAnd(where) {
+		if je := pushTarget(part, byTable, eb.SrcTables); je != nil {
+			perTable[je] = append(perTable[je], part)
+		} else {
+			rest = append(rest, part)
+		}
+	}
+	for je, parts := range perTable {
+		je.filterExpr = joinAnd(parts)
+		f, err := eb.MakeBool(je.filterExpr)
+		if err != nil {
+			return nil, nil, err
+		}
+		je.filter = f
+	}
+	if len(rest) == 0 {
+		return goodCondition, nil, nil
+	}
+	e, err := eb.MakeBool(joinAnd(rest))
+	return e, joinAnd(rest), err
+}
+
+// pushTarget is the joinElement that can apply a WHERE part alone, or nil
+func pushTarget(part sqlparser.BoolExpr, byTable map[string]*joinElement, src base.SrcTables) *joinElement {
+	tables, ok := refTables(part, src)
+	if !ok || len(tables) != 1 {
+		return nil
+	}
+	for name := range tables {
+		if je := byTable[name]; je != nil && !je.fullOther {
+			return je
+		}
+	}
+	return nil
+}
+
+// splitAnd lists the parts of a tree of ANDs
+func splitAnd(b sqlparser.BoolExpr) []sqlparser.BoolExpr {
+	switch t := b.(type) {
+	case *sqlparser.AndExpr:
+		return append(splitAnd(t.Left), splitAnd(t.Right)...)
+	case *sqlparser.ParenBoolExpr:
+		if _, ok := t.Expr.(*sqlparser.AndExpr); ok {
+			return splitAnd(t.Expr)
+		}
+	}
+	return []sqlparser.BoolExpr{b}
+}
+
+func joinAnd(parts []sqlparser.BoolExpr) sqlparser.BoolExpr {
+	res := parts[0]
+	for _, p := range parts[1:] {
+		res = &sqlparser.AndExpr{Left: res, Right: p}
+	}
+	return res
+}
+
+// refTables names the source tables an expression reads.
+// ok is false for anything that cannot be placed on one table alone, like
+// subqueries or unresolvable names.
+func refTables(node sqlparser.Expr, src base.SrcTables) (tables map[string]bool, ok bool) {
+	cols, ok := colRefs(node)
+	if !ok {
+		return nil, false
+	}
+	tables = map[string]bool{}
+	for _, c := range cols {
+		ref, err := src.ResolveRefAndMarkUsed(colRefName(c))
+		if err != nil {
+			return nil, false
+		}
+		tables[tableOfRef(ref)] = true
+	}
+	return tables, true
+}
+
+// colRefs lists the columns an expression reads.
+// ok is false for subqueries and star args, whose reads aren't listed.
+func colRefs(node sqlparser.Expr) (cols []*sqlparser.ColName, ok bool) {
+	var walk func(n sqlparser.Expr) bool
+	walkAll := func(ns ...sqlparser.Expr) bool {
+		for _, n := range ns {
+			if n != nil && !walk(n) {
+				return false
+			}
+		}
+		return true
+	}
+	walk = func(n sqlparser.Expr) bool {
+		switch t := n.(type) {
+		case *sqlparser.AndExpr:
+			return walkAll(t.Left, t.Right)
+		case *sqlparser.OrExpr:
+			return walkAll(t.Left, t.Right)
+		case *sqlparser.NotExpr:
+			return walk(t.Expr)
+		case *sqlparser.ParenBoolExpr:
+			return walk(t.Expr)
+		case *sqlparser.ComparisonExpr:
+			return walkAll(t.Left, t.Right)
+		case *sqlparser.RangeCond:
+			return walkAll(t.Left, t.From, t.To)
+		case *sqlparser.NullCheck:
+			return walk(t.Expr)
+		case sqlparser.StrVal, sqlparser.NumVal, *sqlparser.NullVal:
+			return true
+		case *sqlparser.ColName:
+			cols = append(cols, t)
+			return true
+		case sqlparser.ValTuple:
+			for _, v := range t {
+				if !walk(v) {
+					return false
+				}
+			}
+			return true
+		case *sqlparser.BinaryExpr:
+			return walkAll(t.Left, t.Right)
+		case *sqlparser.UnaryExpr:
+			return walk(t.Expr)
+		case *sqlparser.FuncExpr:
+			for _, arg := range t.Exprs {
+				nse, isNonStar := arg.(*sqlparser.NonStarExpr)
+				if !isNonStar || !walk(nse.Expr) {
+					return false
+				}
+			}
+			return true
+		case *sqlparser.CaseExpr:
+			if !walkAll(t.Expr, t.Else) {
+				return false
+			}
+			for _, w := range t.Whens {
+				if !walkAll(w.Cond, w.Val) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+	return cols, walk(node)
+}
+
+// colRefName is how a column is written, for ResolveRefAndMarkUsed
+func colRefName(c *sqlparser.ColName) string {
+	n := string(c.Name)
+	if len(c.Qualifier) > 0 {
+		n = string(c.Qualifier) + "." + n
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package nodb
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/sel"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Prepared is a SELECT built once, to run many times on fresh tables and
+// args. It is safe for concurrent use. The plan and expressions are built
+// for the proto's tables (or the first run's, without a proto); each run
+// then only binds its own tables, args and functions. A run on tables
+// laid out differently is refused.
+type Prepared struct {
+	query string
+	tree  sqlparser.SelectStatement
+	mu    sync.Mutex
+	q     *sel.Query // nil until built
+}
+
+// Prepare parses query once. If proto is given, the query is also built
+// against it: tables (an empty []Struct is enough) and functions by the
+// names later runs will use, so mistyped columns fail here rather than
+// in the hot path.
+func Prepare(query string, proto Obj) (*Prepared, error) {
+	tree, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &Prepared{query: query, tree: tree}
+	if proto != nil {
+		if _, err := p.built(proto); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// built is the query, built against src's tables the first time
+func (p *Prepared) built(src Obj) (*sel.Query, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.q != nil {
+		return p.q, nil
+	}
+	names := bindNames(p.tree)
+	args := make([]driver.NamedValue, 0, len(names))
+	for n := range names { // NULL stands in for every arg
+		args = append(args, driver.NamedValue{Name: n[1:]})
+	}
+	q, err := sel.Compile(p.tree, base.Obj(bindArgs(src, args)))
+	if err != nil {
+		return nil, err
+	}
+	p.q = q
+	return q, nil
+}
+
+func (p *Prepared) String() string {
+	return p.query
+}
+
+// Do runs the query like DoArgs
+func (p *Prepared) Do(result interface{}, src Obj, args ...interface{}) error {
+	named := namedArgs(args)
+	if err := checkArgs(p.tree, named); err != nil {
+		return err
+	}
+	q, err := p.built(src)
+	if err != nil {
+		return err
+	}
+	return q.Do(result, base.Obj(bindArgs(src, named)))
+}
+
+// QueryPrepared runs p like Query
+func QueryPrepared[T any](ctx context.Context, p *Prepared, src Obj, args ...interface{}) ([]T, error) {
+	res := []T{}
+	var q *sel.Query
+	err := checkArgs(p.tree, namedArgs(args))
+	if err == nil {
+		q, err = p.built(src)
+	}
+	for v, err := range seq[T](ctx, q.GetChan, err, src, args) {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
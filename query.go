@@ -0,0 +1,110 @@
+package nodb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+	"reflect"
+
+	"github.com/snadrus/nodb/internal/base"
+	"github.com/snadrus/nodb/internal/sel"
+)
+
+// Query runs a SELECT against src, returning each row as a T: a struct,
+// whose fields take columns by name, a map[string]interface{}, or a scalar
+// for one-column rows.
+// args fill placeholders as in DoArgs.
+func Query[T any](ctx context.Context, query string, src Obj, args ...interface{}) ([]T, error) {
+	res := []T{}
+	for v, err := range QuerySeq[T](ctx, query, src, args...) {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// QueryOne is Query's first row, or sql.ErrNoRows. The query stops there.
+func QueryOne[T any](ctx context.Context, query string, src Obj, args ...interface{}) (T, error) {
+	for v, err := range QuerySeq[T](ctx, query, src, args...) {
+		return v, err
+	}
+	var zero T
+	return zero, sql.ErrNoRows
+}
+
+// QuerySeq streams Query's rows as they are made. Stopping early stops the
+// query. An error is the last thing yielded.
+func QuerySeq[T any](ctx context.Context, query string, src Obj, args ...interface{}) iter.Seq2[T, error] {
+	tree, err := parseSelect(query)
+	getChan := func(src base.Obj, ctx context.Context) (chan base.GetChanError, chan []string) {
+		return sel.GetChan(tree, src, ctx)
+	}
+	return seq[T](ctx, getChan, err, src, args)
+}
+
+// seq runs a SELECT for QuerySeq & QueryPrepared, or yields err.
+func seq[T any](ctx context.Context, getChan func(base.Obj, context.Context) (chan base.GetChanError, chan []string), err error, src Obj, args []interface{}) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if err == nil {
+			err = checkDest(reflect.TypeOf(&zero).Elem())
+		}
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ch, chColNames := getChan(base.Obj(bindArgs(src, namedArgs(args))), ctx)
+		var colNames []string
+		for row := range ch {
+			if row.Err != nil {
+				yield(zero, row.Err)
+				return
+			}
+			if colNames == nil {
+				colNames = <-chColNames
+			}
+			var v T
+			if err := sel.DecodeRow(colNames, row.Item, &v); err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil { // cut short by the caller's ctx
+			yield(zero, err)
+		}
+	}
+}
+
+// checkDest fails early for row types DecodeRow can't fill
+func checkDest(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Map, reflect.Slice:
+		if t != reflect.TypeOf(map[string]interface{}{}) && t != reflect.TypeOf([]byte{}) {
+			return fmt.Errorf("Rows can't be a %s: use a struct, map[string]interface{} or scalar", t)
+		}
+	}
+	return nil
+}
+
+// Each calls fn with every row as it is made, never holding more than a few
+// rows, so it suits huge channel tables. An error from fn stops the query
+// and is returned.
+func Each[T any](ctx context.Context, query string, src Obj, fn func(row T) error, args ...interface{}) error {
+	for v, err := range QuerySeq[T](ctx, query, src, args...) {
+		if err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package nodb
+
+import "github.com/snadrus/nodb/internal/base"
+
+// Table is a table source of your own, such as a B-tree, ring buffer or
+// cache. Pass it in Obj or to Add like a slice; it is read in place.
+//
+// Columns gives the schema. Open starts a pass over every row and may be
+// called more than once per query, so each Cursor must start from the top.
+// Every Cursor is Closed, even when the query stops early (LIMIT, an error,
+// a cancelled ctx), though perhaps just after the query returns.
+type Table = base.Table
+
+// Column is a name and the Go type of its values (nil if unknown or mixed).
+type Column = base.Column
+
+// Cursor walks a Table's rows. Next fills one value per column, in Columns
+// order, and returns io.EOF after the last row.
+type Cursor = base.Cursor
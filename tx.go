@@ -0,0 +1,104 @@
+package nodb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// session is what a Conn shares with its statements
+type session struct {
+	tx *Tx // open transaction, if any
+}
+
+// Tx gives snapshot isolation. At Begin it takes its own copy of each
+// *[]struct table; its statements read and change those. Commit puts the
+// changes in place at once, failing if another commit changed the same
+// tables first. Rollback just drops them.
+type Tx struct {
+	catalog  *Catalog
+	sess     *session
+	tables   Obj // the catalog at Begin, with our own *[]struct tables
+	began    map[string]txTable
+	readOnly bool
+}
+
+type txTable struct {
+	orig reflect.Value // the catalog's *[]struct
+	rows reflect.Value // *orig at Begin
+	mine reflect.Value // our *[]struct
+}
+
+// BeginTx starts a transaction. Isolation levels up to sql.LevelSnapshot
+// are met; stronger ones are refused.
+func (c Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.sess.tx != nil {
+		return nil, errors.New("Transaction already open")
+	}
+	if level := sql.IsolationLevel(opts.Isolation); level > sql.LevelSnapshot {
+		return nil, fmt.Errorf("No support for isolation level %s", level)
+	}
+	tx := c.catalog.begin()
+	tx.sess, tx.readOnly = c.sess, opts.ReadOnly
+	c.sess.tx = tx
+	return tx, nil
+}
+
+func (c *Catalog) begin() *Tx {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tx := &Tx{
+		catalog: c,
+		tables:  make(Obj, len(c.tables)),
+		began:   map[string]txTable{},
+	}
+	for k, v := range c.tables {
+		if vo, ok := writable(v); ok {
+			mine := reflect.New(vo.Elem().Type()) // Exec replaces slices, never changes them
+			mine.Elem().Set(vo.Elem())
+			tx.began[k] = txTable{orig: vo, rows: reflect.ValueOf(vo.Elem().Interface()), mine: mine}
+			v = mine.Interface()
+		}
+		tx.tables[k] = v
+	}
+	return tx
+}
+
+func (t *Tx) Commit() error {
+	if t.sess.tx != t {
+		return errors.New("Transaction already ended")
+	}
+	t.sess.tx = nil
+	c := t.catalog
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed []txTable
+	for name, tt := range t.began {
+		if sameRows(tt.mine.Elem(), tt.rows) {
+			continue
+		}
+		if cur, ok := c.tables[name]; !ok || cur != tt.orig.Interface() || !sameRows(tt.orig.Elem(), tt.rows) {
+			return fmt.Errorf("Table %s changed since the transaction began, rolled back", name)
+		}
+		changed = append(changed, tt)
+	}
+	for _, tt := range changed {
+		tt.orig.Elem().Set(tt.mine.Elem())
+	}
+	return nil
+}
+
+func (t *Tx) Rollback() error {
+	if t.sess.tx == t {
+		t.sess.tx = nil
+	}
+	return nil
+}
+
+// sameRows is true when a and b are the same slice
+func sameRows(a, b reflect.Value) bool {
+	return a.Pointer() == b.Pointer() && a.Len() == b.Len()
+}